@@ -0,0 +1,4 @@
+-- unique keys of the dedup conflict mode, see DedupConfig.
+-- CONCURRENTLY cannot run in a transaction, apply the statements one by one
+CREATE UNIQUE INDEX CONCURRENTLY xmp_transactions_tid ON xmp_transactions (tid);
+CREATE UNIQUE INDEX CONCURRENTLY xmp_campaigns_access_tid ON xmp_campaigns_access (tid);
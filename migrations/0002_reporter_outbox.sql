@@ -0,0 +1,9 @@
+-- reporter events written with the event row, published by the outbox relay
+CREATE TABLE xmp_reporter_outbox (
+    id         BIGSERIAL PRIMARY KEY,
+    queue      VARCHAR(127) NOT NULL,
+    body       TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at    TIMESTAMP
+);
+CREATE INDEX xmp_reporter_outbox_pending ON xmp_reporter_outbox (id) WHERE sent_at IS NULL;
@@ -0,0 +1,11 @@
+-- subscription result changes rejected by the transition table, written with transitions.audit
+CREATE TABLE xmp_subscriptions_rejected_transitions (
+    id              BIGSERIAL PRIMARY KEY,
+    id_subscription BIGINT NOT NULL,
+    tid             VARCHAR(127) NOT NULL DEFAULT '',
+    msisdn          VARCHAR(32) NOT NULL DEFAULT '',
+    event           VARCHAR(64) NOT NULL,
+    result_from     VARCHAR(32) NOT NULL,
+    result_to       VARCHAR(32) NOT NULL,
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
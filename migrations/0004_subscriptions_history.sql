@@ -0,0 +1,13 @@
+-- one row for every changed subscription field, written with history.enabled
+CREATE TABLE xmp_subscriptions_history (
+    id              BIGSERIAL PRIMARY KEY,
+    id_subscription BIGINT NOT NULL,
+    msisdn          VARCHAR(32) NOT NULL DEFAULT '',
+    tid             VARCHAR(127) NOT NULL DEFAULT '',
+    event           VARCHAR(64) NOT NULL,
+    field           VARCHAR(64) NOT NULL,
+    old_value       TEXT NOT NULL DEFAULT '',
+    new_value       TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX xmp_subscriptions_history_msisdn ON xmp_subscriptions_history (msisdn, created_at);
@@ -0,0 +1,9 @@
+-- metadata of the blacklisted numbers, the temporary ones are lifted at expires_at
+ALTER TABLE xmp_msisdn_blacklist
+    ADD COLUMN reason        VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN source        VARCHAR(127) NOT NULL DEFAULT '',
+    ADD COLUMN operator_code INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN added_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+    ADD COLUMN expires_at    TIMESTAMP;
+CREATE INDEX xmp_msisdn_blacklist_expires_at ON xmp_msisdn_blacklist (expires_at)
+    WHERE expires_at IS NOT NULL;
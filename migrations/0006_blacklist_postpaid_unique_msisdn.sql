@@ -0,0 +1,3 @@
+-- AddBlacklistedNumber and AddPostPaidNumber upsert on these keys
+CREATE UNIQUE INDEX xmp_msisdn_blacklist_msisdn ON xmp_msisdn_blacklist (msisdn);
+CREATE UNIQUE INDEX xmp_msisdn_postpaid_msisdn ON xmp_msisdn_postpaid (msisdn);
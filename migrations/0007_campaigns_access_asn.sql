@@ -0,0 +1,5 @@
+-- ASN of the hit IP and the mismatch with the operator claimed by the dispatcher
+ALTER TABLE xmp_campaigns_access
+    ADD COLUMN geoip_asn              BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN geoip_asn_organization VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN operator_ip_mismatch   BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+-- client IP picked from the raw forwarded chain
+ALTER TABLE xmp_campaigns_access ADD COLUMN client_ip VARCHAR(64) NOT NULL DEFAULT '';
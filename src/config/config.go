@@ -50,6 +50,7 @@ func LoadConfig() AppConfig {
 	appConfig.Consumer.Conn.Host = envString("RBMQ_HOST", appConfig.Consumer.Conn.Host)
 
 	appConfig.Service.GeoIpPath = envString("GEOIP_PATH", appConfig.Service.GeoIpPath)
+	appConfig.Service.GeoIpAsnPath = envString("GEOIP_ASN_PATH", appConfig.Service.GeoIpAsnPath)
 
 	log.WithField("config", fmt.Sprintf("%#v", appConfig)).Info("Config loaded")
 	return appConfig
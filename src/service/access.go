@@ -2,15 +2,8 @@ package service
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
-	"net"
-	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
-	"github.com/ua-parser/uap-go/uaparser"
 
 	mid "github.com/linkit360/go-mid/service"
 	"github.com/linkit360/go-utils/structs"
@@ -21,243 +14,278 @@ type EventNotifyAccessCampaign struct {
 	EventData structs.AccessCampaignNotify `json:"event_data,omitempty"`
 }
 
-func processAccessCampaign(deliveries <-chan amqp.Delivery) {
+// accessCampaignHit is the access campaign event enriched with geoip and user agent data
+type accessCampaignHit struct {
+	structs.AccessCampaignNotify
+	// ClientIp is picked from the forwarded chain in IP
+	ClientIp string
+	IpInfo   IpInfo
+	AsnInfo  AsnInfo
+	// OperatorIpMismatch is set when the IP is not in the networks of the operator
+	OperatorIpMismatch bool
+	Os                 string
+	Device             string
+	Browser            string
+}
 
-	for msg := range deliveries {
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.AccessCampaign.Name,
-		})
-		var ipInfo IpInfo
-		var err error
-		var os string
-		var device string
-		var browser string
-		var begin time.Time
-		var query string
-		var IPs []string
-		var ua *uaparser.Client
-		var e EventNotifyAccessCampaign
-		var t structs.AccessCampaignNotify
+type accessCampaignHandler struct{}
 
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.AccessCampaign.Dropped.Inc()
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-				"body":  string(msg.Body),
-				"msg":   "dropped",
-			}).Error("failed")
-			goto ack
-		}
-		t = e.EventData
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid": t.Tid,
-		})
-		if t.CampaignHash == "" {
-			logCtx.Error("no campaign hash")
-		}
-		if t.Tid == "" {
-			logCtx.Error("no tid")
-		}
-		// todo: add check for every field
-		if len(t.Msisdn) > 32 {
-			logCtx.WithFields(log.Fields{
-				"error": "msisdn is too long",
-			}).Error("strange msisdn, truncating")
-			t.Msisdn = t.Msisdn[:31]
-		}
-		if t.UrlPath == "" {
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-			}).Warn("no urlpath")
-		}
-		if t.Tid == "" {
-			svc.m.AccessCampaign.Dropped.Inc()
-			svc.m.AccessCampaign.Empty.Inc()
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-			}).Warn("no tid")
-			goto ack
-		}
-		if t.CampaignId == "" {
-			t.CampaignId = "-"
-		}
-		if t.ServiceCode == "" {
-			t.ServiceCode = "-"
-		}
-		if t.ContentCode == "" {
-			t.ContentCode = "-"
-		}
+func (accessCampaignHandler) Queue() string {
+	return svc.sConfig.Queue.AccessCampaign.Name
+}
 
-		IPs = strings.Split(t.IP, ", ")
-		for _, ip := range IPs {
-			ipInfo, err = geoIp(ip)
-			if err == nil {
-				break
-			}
-		}
+func (accessCampaignHandler) Metrics() *queueMetrics {
+	return &svc.m.AccessCampaign.queueMetrics
+}
 
-		ua = svc.uaparser.Parse(t.UserAgent)
-		os = ua.Os.ToString()
-		device = ua.Device.ToString()
-		browser = ua.UserAgent.ToString()
+func (accessCampaignHandler) Decode(body []byte) (*Event, error) {
+	var e EventNotifyAccessCampaign
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: &accessCampaignHit{AccessCampaignNotify: e.EventData},
+	}, nil
+}
 
-		if len(os) > 127 {
-			logCtx.WithFields(log.Fields{
-				"error": "os is too long",
-				"os":    os,
-			}).Error("truncating")
-			os = os[:127]
-		}
-		if len(device) > 127 {
-			logCtx.WithFields(log.Fields{
-				"error":  "device is too long",
-				"device": device,
-			}).Error("truncating")
-			device = device[:127]
-		}
-		if len(browser) > 127 {
-			logCtx.WithFields(log.Fields{
-				"error":   "browser is too long",
-				"browser": browser,
-			}).Error("truncating")
-			browser = browser[:127]
-		}
-		if len(t.Referer) > 4091 {
-			logCtx.WithFields(log.Fields{
-				"error":   "referer is too long",
-				"referer": t.Referer,
-			}).Error("truncating")
-			t.Referer = t.Referer[:4091]
-		}
-		if len(t.UserAgent) > 4091 {
-			logCtx.WithFields(log.Fields{
-				"error":     "UserAgent is too long",
-				"UserAgent": t.UserAgent,
-			}).Error("truncating")
-			t.UserAgent = t.UserAgent[:4091]
-		}
-		if len(t.UrlPath) > 4091 {
-			logCtx.WithFields(log.Fields{
-				"error":   "UrlPath is too long",
-				"UrlPath": t.UrlPath,
-			}).Error("truncating")
-			t.UrlPath = t.UrlPath[:4091]
-		}
-		if len(t.Headers) > 4091 {
+func (accessCampaignHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*accessCampaignHit)
+
+	if t.CampaignHash == "" {
+		logCtx.Error("no campaign hash")
+	}
+	// todo: add check for every field
+	if len(t.Msisdn) > 32 {
+		logCtx.WithFields(log.Fields{
+			"error": "msisdn is too long",
+		}).Error("strange msisdn, truncating")
+		t.Msisdn = t.Msisdn[:31]
+	}
+	if t.UrlPath == "" {
+		logCtx.Warn("no urlpath")
+	}
+	if t.Tid == "" {
+		return errEmptyMessage
+	}
+	if t.CampaignId == "" {
+		t.CampaignId = "-"
+	}
+	if t.ServiceCode == "" {
+		t.ServiceCode = "-"
+	}
+	if t.ContentCode == "" {
+		t.ContentCode = "-"
+	}
+
+	var err error
+	if t.ClientIp, err = clientIp(t.IP); err == nil {
+		t.IpInfo, err = geoIp(t.ClientIp)
+	}
+	if err != nil {
+		svc.m.AccessCampaign.ErrorsParseGeoIp.Inc()
+		svc.m.GeoIp.failure(geoIpFailure(err)).Inc()
+		logCtx.WithFields(log.Fields{
+			"ip":    t.IP,
+			"error": err.Error(),
+		}).Debug("geoip")
+	}
+	// the ASN database knows networks the city database may miss,
+	// a failed lookup does not flag the hit
+	if svc.asnDb != nil && t.ClientIp != "" {
+		if t.AsnInfo, err = geoAsn(t.ClientIp); err != nil {
+			logCtx.WithField("error", err.Error()).Debug("asn")
+		} else if t.OperatorIpMismatch = operatorIpMismatch(t.OperatorCode, t.AsnInfo.Number); t.OperatorIpMismatch {
+			svc.m.AccessCampaign.OperatorIpMismatch.Inc()
 			logCtx.WithFields(log.Fields{
-				"error":   "Headers is too long",
-				"Headers": t.Headers,
-			}).Error("truncating")
-			t.Headers = t.Headers[:4091]
+				"operator_code": t.OperatorCode,
+				"asn":           t.AsnInfo.Number,
+				"organization":  t.AsnInfo.Organization,
+			}).Debug("operator ip mismatch")
 		}
-		begin = time.Now()
-		query = fmt.Sprintf("INSERT INTO %scampaigns_access ("+
-			"sent_at, "+
-			"msisdn, "+
-			"tid, "+
-			"ip, "+
-			"os, "+
-			"device, "+
-			"browser, "+
-			"operator_code, "+
-			"country_code, "+
-			"supported, "+
-			"user_agent, "+
-			"referer, "+
-			"url_path, "+
-			"method, "+
-			"headers, "+
-			"error, "+
-			"id_campaign, "+
-			"id_service, "+
-			"geoip_country, "+
-			"geoip_iso, "+
-			"geoip_city, "+
-			"geoip_timezone, "+
-			"geoip_latitude, "+
-			"geoip_longitude, "+
-			"geoip_metro_code, "+
-			"geoip_postal_code, "+
-			"geoip_subdivisions, "+
-			"geoip_is_anonymous_proxy, "+
-			"geoip_is_satellite_provider, "+
-			"geoip_accuracy_radius "+
-			")"+
-			" values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,  "+
-			" $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30)",
-			svc.dbConf.TablePrefix)
+	}
 
-		if _, err := svc.db.Exec(query,
-			t.SentAt,
-			t.Msisdn,
-			t.Tid,
-			t.IP,
-			os,
-			device,
-			browser,
-			t.OperatorCode,
-			t.CountryCode,
-			t.Supported,
-			t.UserAgent,
-			t.Referer,
-			t.UrlPath,
-			t.Method,
-			t.Headers,
-			t.Error,
-			t.CampaignId,
-			t.ServiceCode,
-			ipInfo.Country,
-			ipInfo.Iso,
-			ipInfo.City,
-			ipInfo.Timezone,
-			ipInfo.Latitude,
-			ipInfo.Latitude,
-			ipInfo.MetroCode,
-			ipInfo.PostalCode,
-			ipInfo.Subdivisions,
-			ipInfo.IsAnonymousProxy,
-			ipInfo.IsSatelliteProvider,
-			ipInfo.AccuracyRadius,
-		); err != nil {
-			svc.m.Common.DBErrors.Inc()
-			svc.m.AccessCampaign.AddToDBErrors.Inc()
+	ua := svc.uaparser.Parse(t.UserAgent)
+	t.Os = ua.Os.ToString()
+	t.Device = ua.Device.ToString()
+	t.Browser = ua.UserAgent.ToString()
 
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "requeue",
-				"body":  string(msg.Body),
-				"query": query,
-			}).Error("failed")
+	if len(t.Os) > 127 {
+		logCtx.WithFields(log.Fields{
+			"error": "os is too long",
+			"os":    t.Os,
+		}).Error("truncating")
+		t.Os = t.Os[:127]
+	}
+	if len(t.Device) > 127 {
+		logCtx.WithFields(log.Fields{
+			"error":  "device is too long",
+			"device": t.Device,
+		}).Error("truncating")
+		t.Device = t.Device[:127]
+	}
+	if len(t.Browser) > 127 {
+		logCtx.WithFields(log.Fields{
+			"error":   "browser is too long",
+			"browser": t.Browser,
+		}).Error("truncating")
+		t.Browser = t.Browser[:127]
+	}
+	if len(t.Referer) > 4091 {
+		logCtx.WithFields(log.Fields{
+			"error":   "referer is too long",
+			"referer": t.Referer,
+		}).Error("truncating")
+		t.Referer = t.Referer[:4091]
+	}
+	if len(t.UserAgent) > 4091 {
+		logCtx.WithFields(log.Fields{
+			"error":     "UserAgent is too long",
+			"UserAgent": t.UserAgent,
+		}).Error("truncating")
+		t.UserAgent = t.UserAgent[:4091]
+	}
+	if len(t.UrlPath) > 4091 {
+		logCtx.WithFields(log.Fields{
+			"error":   "UrlPath is too long",
+			"UrlPath": t.UrlPath,
+		}).Error("truncating")
+		t.UrlPath = t.UrlPath[:4091]
+	}
+	if len(t.Headers) > 4091 {
+		logCtx.WithFields(log.Fields{
+			"error":   "Headers is too long",
+			"Headers": t.Headers,
+		}).Error("truncating")
+		t.Headers = t.Headers[:4091]
+	}
+	return nil
+}
+
+// accessCampaignColumns of campaigns_access
+var accessCampaignColumns = []string{
+	"sent_at",
+	"msisdn",
+	"tid",
+	"ip",
+	"client_ip",
+	"os",
+	"device",
+	"browser",
+	"operator_code",
+	"country_code",
+	"supported",
+	"user_agent",
+	"referer",
+	"url_path",
+	"method",
+	"headers",
+	"error",
+	"id_campaign",
+	"id_service",
+	"geoip_country",
+	"geoip_iso",
+	"geoip_city",
+	"geoip_timezone",
+	"geoip_latitude",
+	"geoip_longitude",
+	"geoip_metro_code",
+	"geoip_postal_code",
+	"geoip_subdivisions",
+	"geoip_is_anonymous_proxy",
+	"geoip_is_satellite_provider",
+	"geoip_accuracy_radius",
+	"geoip_asn",
+	"geoip_asn_organization",
+	"operator_ip_mismatch",
+}
+
+func (t *accessCampaignHit) values() []interface{} {
+	return []interface{}{
+		t.SentAt,
+		t.Msisdn,
+		t.Tid,
+		t.IP,
+		t.ClientIp,
+		t.Os,
+		t.Device,
+		t.Browser,
+		t.OperatorCode,
+		t.CountryCode,
+		t.Supported,
+		t.UserAgent,
+		t.Referer,
+		t.UrlPath,
+		t.Method,
+		t.Headers,
+		t.Error,
+		t.CampaignId,
+		t.ServiceCode,
+		t.IpInfo.Country,
+		t.IpInfo.Iso,
+		t.IpInfo.City,
+		t.IpInfo.Timezone,
+		t.IpInfo.Latitude,
+		t.IpInfo.Longitude,
+		t.IpInfo.MetroCode,
+		t.IpInfo.PostalCode,
+		t.IpInfo.Subdivisions,
+		t.IpInfo.IsAnonymousProxy,
+		t.IpInfo.IsSatelliteProvider,
+		t.IpInfo.AccuracyRadius,
+		t.AsnInfo.Number,
+		t.AsnInfo.Organization,
+		t.OperatorIpMismatch,
+	}
+}
+
+func (h accessCampaignHandler) Persist(e *Event) error {
+	return h.PersistBatch([]*Event{e})
+}
 
-			time.Sleep(time.Second)
-			msg.Nack(false, true)
+// PersistBatch writes hits with one call of every sink.
+// A tid repeated in the batch is written once, the other hits are duplicates
+func (accessCampaignHandler) PersistBatch(events []*Event) error {
+	batched := make(map[string]bool, len(events))
+	hits := make([]*accessCampaignHit, 0, len(events))
+	var unique []*Event
+	for _, e := range events {
+		if batched[e.Tid] {
+			e.Duplicate = true
 			continue
 		}
+		batched[e.Tid] = true
+		hits = append(hits, e.Data.(*accessCampaignHit))
+		unique = append(unique, e)
+	}
+	duplicates, err := svc.sinks.AccessCampaign.accessHits(hits)
+	if err != nil {
+		return err
+	}
+	for _, e := range unique {
+		e.Duplicate = duplicates[e.Tid]
+	}
+	return nil
+}
 
-		svc.m.AccessCampaign.AddToDbSuccess.Inc()
-		svc.m.AccessCampaign.AddToDbDuration.Observe(time.Since(begin).Seconds())
-		svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+func (accessCampaignHandler) Publish(e *Event) error {
+	if svc.sinks.AccessCampaign.outboxed() {
+		return nil
+	}
+	r := hitReport(e.Data.(*accessCampaignHit))
+	return publishReporter(r.queue, r.collect)
+}
 
-		logCtx.WithFields(log.Fields{
-			"took": time.Since(begin).String(),
-		}).Info("success")
-		publishReporter(svc.sConfig.Queue.Hit, mid.Collect{
+func hitReport(t *accessCampaignHit) reporterEvent {
+	return reporterEvent{
+		queue: svc.sConfig.Queue.Hit,
+		collect: mid.Collect{
 			Tid:          t.Tid,
 			CampaignUUID: t.CampaignId,
 			OperatorCode: t.OperatorCode,
 			Msisdn:       t.Msisdn,
-		})
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
+		},
 	}
 }
 
@@ -279,28 +307,11 @@ type IpInfo struct {
 
 func geoIp(ip string) (IpInfo, error) {
 	if ip == "" {
-		return IpInfo{}, errors.New("GeoIP Parse: Empty IP")
+		return IpInfo{}, errGeoIpEmpty
 	}
-	record, err := svc.ipDb.City(net.ParseIP(ip))
+	v, err := svc.ipDb.get(ip)
 	if err != nil {
-		return IpInfo{}, fmt.Errorf("GeoIP Parse City: IP: %s: error: %s", ip, err.Error())
-	}
-	ipInfo := IpInfo{
-		Ip:                  ip,                         // => 81.2.69.142
-		Country:             record.Country.Names["en"], // => United Kingdom
-		Iso:                 record.Country.IsoCode,     // => GB
-		City:                record.City.Names["en"],    //  => Arnold
-		Timezone:            record.Location.TimeZone,   // => Europe/London
-		Latitude:            record.Location.Latitude,   // => 53
-		Longitude:           record.Location.Longitude,  // => -1.1333
-		MetroCode:           record.Location.MetroCode,
-		AccuracyRadius:      record.Location.AccuracyRadius,
-		PostalCode:          record.Postal.Code, // => NG5
-		IsAnonymousProxy:    record.Traits.IsAnonymousProxy,
-		IsSatelliteProvider: record.Traits.IsSatelliteProvider,
-	}
-	if len(record.Subdivisions) > 0 {
-		ipInfo.Subdivisions = record.Subdivisions[0].Names["en"] // => England
+		return IpInfo{}, err
 	}
-	return ipInfo, nil
+	return v.(IpInfo), nil
 }
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// recentErrorsSize is how many errors are kept for every queue
+const recentErrorsSize = 100
+
+// AddAdminHandler adds the /admin routes to manage the consumers at runtime.
+// There is no auth: keep the server host on the private interface
+func AddAdminHandler(r *gin.Engine) {
+	rg := r.Group("/admin")
+	rg.GET("/queues", adminQueues)
+	rg.POST("/queues/:name/pause", adminPause)
+	rg.POST("/queues/:name/resume", adminResume)
+	rg.POST("/queues/:name/threads", adminThreads)
+	rg.GET("/queues/:name/errors", adminErrors)
+}
+
+type queueState struct {
+	Name          string     `json:"name"`
+	Enabled       bool       `json:"enabled"`
+	PrefetchCount int        `json:"prefetch_count"`
+	ThreadsCount  int        `json:"threads_count"`
+	Batch         bool       `json:"batch"`
+	Consumer      runnerInfo `json:"consumer"`
+}
+
+type runnerInfo struct {
+	Paused    bool `json:"paused"`
+	Stopped   bool `json:"stopped"`
+	Connected bool `json:"connected"`
+	Threads   int  `json:"threads"`
+	Workers   int  `json:"workers"`
+	InFlight  int  `json:"in_flight"`
+}
+
+func (r *runner) info() runnerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return runnerInfo{
+		Paused:    r.paused,
+		Stopped:   r.stopped,
+		Connected: r.connected,
+		Threads:   r.threads,
+		Workers:   r.workers,
+		InFlight:  r.active,
+	}
+}
+
+func (r *runner) state() queueState {
+	return queueState{
+		Name:          r.conf.Name,
+		Enabled:       r.conf.Enabled,
+		PrefetchCount: r.conf.PrefetchCount,
+		ThreadsCount:  r.conf.ThreadsCount,
+		Batch:         r.batch.Enabled,
+		Consumer:      r.info(),
+	}
+}
+
+func findRunner(name string) *runner {
+	for _, r := range svc.runners {
+		if r.conf.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// adminRunner finds the runner by the name route param, it responds 404 if there is none
+func adminRunner(c *gin.Context) *runner {
+	r := findRunner(c.Param("name"))
+	if r == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown queue"})
+	}
+	return r
+}
+
+func adminQueues(c *gin.Context) {
+	queues := make([]queueState, 0, len(svc.runners))
+	for _, r := range svc.runners {
+		queues = append(queues, r.state())
+	}
+	c.JSON(http.StatusOK, queues)
+}
+
+func adminPause(c *gin.Context) {
+	r := adminRunner(c)
+	if r == nil {
+		return
+	}
+	r.pause()
+	log.WithField("q", r.conf.Name).Info("admin: paused")
+	c.JSON(http.StatusOK, r.state())
+}
+
+func adminResume(c *gin.Context) {
+	r := adminRunner(c)
+	if r == nil {
+		return
+	}
+	r.resume()
+	log.WithField("q", r.conf.Name).Info("admin: resumed")
+	c.JSON(http.StatusOK, r.state())
+}
+
+// adminThreads changes the consumer threads, the count is passed as ?threads=N
+func adminThreads(c *gin.Context) {
+	r := adminRunner(c)
+	if r == nil {
+		return
+	}
+	threads, err := strconv.Atoi(c.Query("threads"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "threads: " + err.Error()})
+		return
+	}
+	if err := r.resize(threads); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.WithFields(log.Fields{
+		"q":       r.conf.Name,
+		"threads": threads,
+	}).Info("admin: resized")
+	c.JSON(http.StatusOK, r.state())
+}
+
+// adminErrors shows the last errors of the queue, ?n=N limits the count
+func adminErrors(c *gin.Context) {
+	r := adminRunner(c)
+	if r == nil {
+		return
+	}
+	n := recentErrorsSize
+	if q := c.Query("n"); q != "" {
+		var err error
+		if n, err = strconv.Atoi(q); err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "n must be a positive number"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, r.errors.last(n))
+}
+
+type recentError struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Tid    string    `json:"tid,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// recentErrors keeps the last errors of the queue in a ring
+type recentErrors struct {
+	mu    sync.Mutex
+	items []recentError
+	next  int
+}
+
+func newRecentErrors(size int) *recentErrors {
+	return &recentErrors{items: make([]recentError, 0, size)}
+}
+
+func (re *recentErrors) add(action, tid string, err error) {
+	e := recentError{
+		Time:   time.Now(),
+		Action: action,
+		Tid:    tid,
+		Error:  err.Error(),
+	}
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if len(re.items) < cap(re.items) {
+		re.items = append(re.items, e)
+		return
+	}
+	re.items[re.next] = e
+	re.next = (re.next + 1) % len(re.items)
+}
+
+// last returns up to n errors, the newest first
+func (re *recentErrors) last(n int) []recentError {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if n > len(re.items) {
+		n = len(re.items)
+	}
+	res := make([]recentError, 0, n)
+	for i := 0; i < n; i++ {
+		idx := (re.next - 1 - i + 2*len(re.items)) % len(re.items)
+		res = append(res, re.items[idx])
+	}
+	return res
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/db"
+)
+
+// BackfillConfig configures the geoip coordinates backfill of campaigns_access
+type BackfillConfig struct {
+	BatchSize int
+	// FromId continues the interrupted backfill
+	FromId int64
+}
+
+// BackfillLongitude recomputes the coordinates of campaigns_access from the stored ip.
+// The insert used to write the latitude into geoip_longitude, so only the rows
+// with both equal are selected. Latitude and longitude are taken from the same
+// lookup: the database may be newer than the one the row was written with.
+// The consumers are not started
+func BackfillLongitude(sConf ServiceConfig, dbConf db.DataBaseConfig, conf BackfillConfig) error {
+	svc.db = db.Init(dbConf)
+	svc.sConfig = sConf
+	svc.dbConf = dbConf
+	defer svc.db.Close()
+
+	var err error
+	if svc.trustedProxies, err = parseCIDRs(sConf.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted proxies: %s", err.Error())
+	}
+	reader, err := geoip2.Open(sConf.GeoIpPath)
+	if err != nil {
+		return fmt.Errorf("geoip2.Open: %s", err.Error())
+	}
+	defer reader.Close()
+
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 1000
+	}
+	begin := time.Now()
+	lastId := conf.FromId
+	var total, updated int
+	for {
+		count, batchUpdated, next, err := backfillBatch(reader, lastId, conf.BatchSize)
+		if err != nil {
+			return fmt.Errorf("from id %d: %s", lastId, err.Error())
+		}
+		total += count
+		updated += batchUpdated
+		lastId = next
+		log.WithFields(log.Fields{
+			"last_id": lastId,
+			"total":   total,
+			"updated": updated,
+		}).Info("backfill longitude progress")
+		if count < conf.BatchSize {
+			break
+		}
+	}
+	log.WithFields(log.Fields{
+		"total":   total,
+		"updated": updated,
+		"took":    time.Since(begin).String(),
+	}).Info("backfill longitude done")
+	return nil
+}
+
+type backfillRow struct {
+	id       int64
+	ip       string
+	clientIp string
+}
+
+func backfillBatch(reader *geoip2.Reader, fromId int64, limit int) (count, updated int, lastId int64, err error) {
+	lastId = fromId
+	query := fmt.Sprintf("SELECT id, ip, client_ip FROM %scampaigns_access "+
+		"WHERE id > $1 AND geoip_latitude <> 0 AND geoip_longitude = geoip_latitude "+
+		"ORDER BY id LIMIT $2",
+		svc.dbConf.TablePrefix,
+	)
+	rows, err := svc.db.Query(query, fromId, limit)
+	if err != nil {
+		return 0, 0, lastId, newDBError("db.Query", err, query)
+	}
+	var batch []backfillRow
+	for rows.Next() {
+		var r backfillRow
+		if err = rows.Scan(&r.id, &r.ip, &r.clientIp); err != nil {
+			rows.Close()
+			return 0, 0, lastId, newDBError("rows.Scan", err, "")
+		}
+		batch = append(batch, r)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, 0, lastId, newDBError("rows.Err", err, "")
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return 0, 0, lastId, nil
+	}
+	lastId = batch[len(batch)-1].id
+
+	query = fmt.Sprintf("UPDATE %scampaigns_access SET "+
+		"geoip_latitude = $1, "+
+		"geoip_longitude = $2 "+
+		"WHERE id = $3",
+		svc.dbConf.TablePrefix)
+	lookup := func(ip string) (interface{}, error) {
+		return cityInfo(reader, ip)
+	}
+	err = withTx(sql.LevelReadCommitted, func(db dbExecutor) error {
+		for _, r := range batch {
+			ipInfo, ok := backfillIpInfo(lookup, r)
+			if !ok {
+				continue
+			}
+			if _, err := db.Exec(query, ipInfo.Latitude, ipInfo.Longitude, r.id); err != nil {
+				return newDBError("db.Exec", err, query)
+			}
+			updated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, lastId, err
+	}
+	return len(batch), updated, lastId, nil
+}
+
+// backfillIpInfo looks up the IP the row has been enriched with: the client ip
+// or, for the rows written before it, the first IP of the chain with a record.
+// A failed lookup or a record without coordinates, e.g. of the country only,
+// leaves the row as it is: zeros would replace the stored latitude
+func backfillIpInfo(lookup func(ip string) (interface{}, error), r backfillRow) (IpInfo, bool) {
+	ips := []string{r.clientIp}
+	if r.clientIp == "" {
+		ips = strings.Split(r.ip, ", ")
+	}
+	for _, ip := range ips {
+		v, err := lookup(ip)
+		if err != nil {
+			continue
+		}
+		if ipInfo := v.(IpInfo); ipInfo.Latitude != 0 || ipInfo.Longitude != 0 {
+			return ipInfo, true
+		}
+	}
+	return IpInfo{}, false
+}
@@ -0,0 +1,40 @@
+package service
+
+import "testing"
+
+func TestBackfillIpInfo(t *testing.T) {
+	records := map[string]IpInfo{
+		"81.2.69.142":   {Ip: "81.2.69.142", Latitude: 53, Longitude: -1.1333},
+		"175.16.199.1":  {Ip: "175.16.199.1", Latitude: 43.88, Longitude: 125.3228},
+		"89.160.20.112": {Ip: "89.160.20.112", Country: "Sweden"},
+	}
+	lookup := func(ip string) (interface{}, error) {
+		if v, ok := records[ip]; ok {
+			return v, nil
+		}
+		return nil, errGeoIpNotFound
+	}
+
+	tests := []struct {
+		name string
+		row  backfillRow
+		ok   bool
+		want string
+	}{
+		{"client ip", backfillRow{ip: "10.0.0.1, 81.2.69.142", clientIp: "81.2.69.142"}, true, "81.2.69.142"},
+		{"client ip not found", backfillRow{ip: "81.2.69.142", clientIp: "216.160.83.56"}, false, ""},
+		{"client ip without coordinates", backfillRow{ip: "81.2.69.142", clientIp: "89.160.20.112"}, false, ""},
+		{"first of the chain with a record", backfillRow{ip: "10.0.0.1, 175.16.199.1, 81.2.69.142"}, true, "175.16.199.1"},
+		{"chain skips the record without coordinates", backfillRow{ip: "89.160.20.112, 81.2.69.142"}, true, "81.2.69.142"},
+		{"nothing in the chain", backfillRow{ip: "10.0.0.1, 89.160.20.112, unknown"}, false, ""},
+	}
+	for _, tt := range tests {
+		ipInfo, ok := backfillIpInfo(lookup, tt.row)
+		if ok != tt.ok || ipInfo.Ip != tt.want {
+			t.Errorf("%s: backfillIpInfo = %q, %v, want %q, %v", tt.name, ipInfo.Ip, ok, tt.want, tt.ok)
+		}
+		if ok && ipInfo.Latitude == 0 && ipInfo.Longitude == 0 {
+			t.Errorf("%s: zero coordinates selected", tt.name)
+		}
+	}
+}
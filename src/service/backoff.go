@@ -0,0 +1,144 @@
+package service
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackoffConfig is the delay before the failed message is requeued,
+// it grows with every failed attempt of the message
+type BackoffConfig struct {
+	InitialMs  int     `yaml:"initial_ms" default:"1000"`
+	MaxMs      int     `yaml:"max_ms" default:"60000"`
+	Multiplier float64 `yaml:"multiplier" default:"2"`
+	// Jitter is the random part of the delay, 0.2 means +-20%
+	Jitter float64 `yaml:"jitter" default:"0.2"`
+}
+
+// delay returns the pause before requeue after the attempt-th failure
+func (b BackoffConfig) delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(b.InitialMs) * math.Pow(b.Multiplier, float64(attempt-1))
+	if max := float64(b.MaxMs); b.MaxMs > 0 && d > max {
+		d = max
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+// BreakerConfig pauses all consumers when the db error rate
+// in the window is above error_rate, consuming is resumed once
+// the db answers the ping
+type BreakerConfig struct {
+	Enabled         bool    `yaml:"enabled"`
+	ErrorRate       float64 `yaml:"error_rate" default:"0.5"`
+	MinRequests     int     `yaml:"min_requests" default:"20"`
+	WindowSeconds   int     `yaml:"window_seconds" default:"10"`
+	ProbeIntervalMs int     `yaml:"probe_interval_ms" default:"5000"`
+}
+
+type breaker struct {
+	conf BreakerConfig
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	errors      int
+	resume      chan struct{}
+}
+
+func newBreaker(conf BreakerConfig) *breaker {
+	return &breaker{
+		conf:        conf,
+		windowStart: time.Now(),
+	}
+}
+
+// wait blocks while the breaker is open or until stop is closed
+func (b *breaker) wait(stop <-chan struct{}) {
+	if !b.conf.Enabled {
+		return
+	}
+	b.mu.Lock()
+	resume := b.resume
+	b.mu.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-stop:
+	}
+}
+
+// record counts the db call result, permanent errors are data errors
+// and do not say anything about db health
+func (b *breaker) record(err error) {
+	if !b.conf.Enabled {
+		return
+	}
+	failed := err != nil && classifyDBError(err) != errPermanent
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.windowStart) > time.Duration(b.conf.WindowSeconds)*time.Second {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.errors = 0
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	if b.resume != nil || b.requests < b.conf.MinRequests {
+		return
+	}
+	rate := float64(b.errors) / float64(b.requests)
+	if rate < b.conf.ErrorRate {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"errors":   b.errors,
+		"requests": b.requests,
+		"rate":     rate,
+	}).Error("db circuit breaker is open, consumers paused")
+	svc.m.Common.BreakerOpen.Set(1)
+	b.resume = make(chan struct{})
+	go b.probe()
+}
+
+// probe pings the db until it answers and closes the breaker
+func (b *breaker) probe() {
+	for {
+		time.Sleep(time.Duration(b.conf.ProbeIntervalMs) * time.Millisecond)
+		if err := svc.db.Ping(); err != nil {
+			log.WithField("error", err.Error()).Warn("db circuit breaker probe failed")
+			continue
+		}
+		break
+	}
+
+	b.mu.Lock()
+	close(b.resume)
+	b.resume = nil
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.errors = 0
+	b.mu.Unlock()
+
+	svc.m.Common.BreakerOpen.Set(0)
+	log.Info("db circuit breaker is closed, consumers resumed")
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := BackoffConfig{InitialMs: 1000, MaxMs: 60000, Multiplier: 2}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := b.delay(tt.attempt); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+
+	b.MaxMs = 0
+	if got := b.delay(8); got != 128*time.Second {
+		t.Errorf("delay without max = %s, want 2m8s", got)
+	}
+}
+
+func TestBackoffDelayJitter(t *testing.T) {
+	b := BackoffConfig{InitialMs: 1000, MaxMs: 60000, Multiplier: 2, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if got := b.delay(3); got < 3200*time.Millisecond || got > 4800*time.Millisecond {
+			t.Fatalf("delay(3) = %s, want 4s +-20%%", got)
+		}
+		if got := b.delay(10); got < 48*time.Second || got > 72*time.Second {
+			t.Fatalf("delay(10) = %s, want 1m +-20%%", got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlacklistConfig configures the sweeper lifting the temporary blacklists
+type BlacklistConfig struct {
+	// SweepMinutes is the period of the expiry sweep, 0 disables it
+	SweepMinutes int `yaml:"sweep_minutes" default:"10"`
+}
+
+// blacklistMeta is sent in event_data of AddBlacklistedNumber along with the record.
+// The number without expires_at is blacklisted until it is removed
+type blacklistMeta struct {
+	Reason    string     `json:"reason,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newBlacklistSweeper(conf BlacklistConfig) *sweeper {
+	return newSweeper(time.Duration(conf.SweepMinutes)*time.Minute, sweepBlacklist)
+}
+
+// sweepBlacklist removes the expired temporary blacklists
+func sweepBlacklist() {
+	begin := time.Now()
+	query := fmt.Sprintf("DELETE FROM %smsisdn_blacklist "+
+		"WHERE expires_at IS NOT NULL AND expires_at < NOW()",
+		svc.dbConf.TablePrefix)
+
+	res, err := svc.db.Exec(query)
+	if err != nil {
+		svc.m.Common.DBErrors.Inc(classifyDBError(err))
+		log.WithFields(log.Fields{
+			"query": query,
+			"error": err.Error(),
+		}).Error("blacklist sweep")
+		return
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("blacklist sweep: rows affected")
+		return
+	}
+	svc.m.MTManager.BlacklistExpiredRows.Observe(float64(count))
+	if count > 0 {
+		log.WithFields(log.Fields{
+			"count": count,
+			"took":  time.Since(begin).String(),
+		}).Info("expired blacklists lifted")
+	}
+}
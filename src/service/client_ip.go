@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// reservedNets are skipped in the forwarded chain along with private,
+// loopback, link-local and multicast addresses: they are not the client
+var reservedNets = mustParseCIDRs([]string{
+	"0.0.0.0/8",
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+	"2001:db8::/32",
+})
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// parseCIDRs parses networks, a single IP is taken as the network of one address
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s: %s", cidr, err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp picks the client from the X-Forwarded-For chain. The chain is walked
+// from the right: the addresses added by our proxies are trusted, the first
+// public address before them is the client. The left part is set by the client
+// and may be spoofed. The error is the geoip failure reason
+func clientIp(chain string) (string, error) {
+	if strings.TrimSpace(chain) == "" {
+		return "", errGeoIpEmpty
+	}
+	parsed := false
+	parts := strings.Split(chain, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := parseForwardedIp(parts[i])
+		if ip == nil {
+			continue
+		}
+		parsed = true
+		if inNets(ip, svc.trustedProxies) || !publicIp(ip) {
+			continue
+		}
+		return ip.String(), nil
+	}
+	if !parsed {
+		return "", errGeoIpParse
+	}
+	return "", errGeoIpPrivate
+}
+
+// parseForwardedIp accepts 1.2.3.4, 1.2.3.4:80, 2001:db8::1,
+// [2001:db8::1] and [2001:db8::1]:80
+func parseForwardedIp(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if s == "" {
+		return nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(s[1:end])
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func publicIp(ip net.IP) bool {
+	if ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	return !inNets(ip, reservedNets)
+}
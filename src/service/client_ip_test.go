@@ -0,0 +1,70 @@
+package service
+
+import "testing"
+
+func TestClientIp(t *testing.T) {
+	saved := svc.trustedProxies
+	defer func() {
+		svc.trustedProxies = saved
+	}()
+	svc.trustedProxies = mustParseCIDRs([]string{"81.2.69.0/24", "89.160.20.112"})
+
+	tests := []struct {
+		name  string
+		chain string
+		want  string
+		err   error
+	}{
+		{"single client", "175.16.199.1", "175.16.199.1", nil},
+		{"walked from the right", "175.16.199.1, 216.160.83.56", "216.160.83.56", nil},
+		{"spoofed left part", "8.8.8.8, 175.16.199.1, 81.2.69.142", "175.16.199.1", nil},
+		{"trusted proxies", "175.16.199.1, 89.160.20.112, 81.2.69.10", "175.16.199.1", nil},
+		{"private hops", "175.16.199.1, 10.0.0.1, 192.168.1.1, 127.0.0.1", "175.16.199.1", nil},
+		{"carrier nat", "175.16.199.1, 100.64.0.1", "175.16.199.1", nil},
+		{"private client behind the proxy", "10.0.0.1, 81.2.69.142", "", errGeoIpPrivate},
+		{"all private", "10.0.0.1, 172.16.0.1, 192.168.0.1, ::1, fe80::1", "", errGeoIpPrivate},
+		{"ipv6", "2a02:6b8::feed:ff, 10.0.0.1", "2a02:6b8::feed:ff", nil},
+		{"ipv6 in brackets with port", "[2a02:6b8::feed:ff]:443", "2a02:6b8::feed:ff", nil},
+		{"ipv6 documentation", "2001:db8::1", "", errGeoIpPrivate},
+		{"ipv4 with port", "175.16.199.1:8080, 10.0.0.1:80", "175.16.199.1", nil},
+		{"quoted", `"175.16.199.1"`, "175.16.199.1", nil},
+		{"garbage skipped", "175.16.199.1, unknown, 10.0.0.1", "175.16.199.1", nil},
+		{"only garbage", "unknown, -, [::1", "", errGeoIpParse},
+		{"empty", " ", "", errGeoIpEmpty},
+	}
+	for _, tt := range tests {
+		got, err := clientIp(tt.chain)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: clientIp(%q) = %q, %v, want %q, %v", tt.name, tt.chain, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseForwardedIp(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"175.16.199.1", "175.16.199.1"},
+		{" 175.16.199.1 ", "175.16.199.1"},
+		{"175.16.199.1:80", "175.16.199.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+		{`"[2001:db8::1]:80"`, "2001:db8::1"},
+		{"", ""},
+		{"unknown", ""},
+		{"175.16.199", ""},
+		{"[2001:db8::1", ""},
+		{"host:80", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if ip := parseForwardedIp(tt.s); ip != nil {
+			got = ip.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseForwardedIp(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
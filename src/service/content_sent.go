@@ -2,120 +2,60 @@ package service
 
 import (
 	"encoding/json"
-	"fmt"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	"github.com/linkit360/go-utils/structs"
 )
 
-func processContentSent(deliveries <-chan amqp.Delivery) {
-	for msg := range deliveries {
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.ContentSent.Name,
-		})
-		var begin time.Time
-		var t structs.ContentSentProperties
-		var query string
+type contentSentHandler struct{}
 
-		var e structs.EventNotifyContentSent
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.ContentSent.Dropped.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("failed")
-			goto ack
-		}
-		t = e.EventData
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid": t.Tid,
-		})
-		if t.CampaignId == "" ||
-			t.ServiceCode == "" {
-			svc.m.ContentSent.Dropped.Inc()
-			svc.m.ContentSent.Empty.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("failed")
-			goto ack
-		}
-		// todo: add check for every field
-		if len(t.Msisdn) > 32 {
-			logCtx.WithFields(log.Fields{
-				"msisdn": t.Msisdn,
-				"error":  "too long msisdn",
-			}).Error("strange msisdn")
-			t.Msisdn = t.Msisdn[:31]
-		}
+func (contentSentHandler) Queue() string {
+	return svc.sConfig.Queue.ContentSent.Name
+}
 
-		begin = time.Now()
-		query = fmt.Sprintf("INSERT INTO %scontent_sent ("+
-			"sent_at, "+
-			"msisdn, "+
-			"tid, "+
-			"id_campaign, "+
-			"id_service, "+
-			"id_content, "+
-			"id_subscription, "+
-			"country_code, "+
-			"operator_code "+
-			") values ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
-			svc.dbConf.TablePrefix)
+func (contentSentHandler) Metrics() *queueMetrics {
+	return &svc.m.ContentSent.queueMetrics
+}
 
-		if _, err := svc.db.Exec(query,
-			t.SentAt,
-			t.Msisdn,
-			t.Tid,
-			t.CampaignId,
-			t.ServiceCode,
-			t.ContentId,
-			t.SubscriptionId,
-			t.CountryCode,
-			t.OperatorCode,
-		); err != nil {
-			svc.m.Common.DBErrors.Inc()
-			svc.m.ContentSent.AddToDBErrors.Inc()
-			time.Sleep(time.Second)
-			logCtx.WithFields(log.Fields{
-				"query": query,
-				"msg":   "requeue",
-				"error": err.Error(),
-			}).Error("failed")
-		nack:
-			if err := msg.Nack(false, true); err != nil {
-				logCtx.WithFields(log.Fields{
-					"error": err.Error(),
-				}).Error("cannot nack")
-				time.Sleep(time.Second)
-				goto nack
-			}
-			continue
-		}
+func (contentSentHandler) Decode(body []byte) (*Event, error) {
+	var e structs.EventNotifyContentSent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: &e.EventData,
+	}, nil
+}
 
-		svc.m.ContentSent.AddToDbSuccess.Inc()
-		svc.m.ContentSent.AddToDBDuration.Observe(time.Since(begin).Seconds())
-		svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+func (contentSentHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*structs.ContentSentProperties)
 
+	if t.CampaignId == "" ||
+		t.ServiceCode == "" {
+		return errEmptyMessage
+	}
+	// todo: add check for every field
+	if len(t.Msisdn) > 32 {
 		logCtx.WithFields(log.Fields{
-			"took": time.Since(begin).String(),
-		}).Info("success")
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
+			"msisdn": t.Msisdn,
+			"error":  "too long msisdn",
+		}).Error("strange msisdn")
+		t.Msisdn = t.Msisdn[:31]
 	}
+	return nil
+}
+
+func (contentSentHandler) Persist(e *Event) (err error) {
+	t := e.Data.(*structs.ContentSentProperties)
+	e.Duplicate, err = svc.sinks.ContentSent.write(func(s Sink) (bool, error) {
+		return s.ContentSent(t)
+	})
+	return
+}
+
+func (contentSentHandler) Publish(e *Event) error {
+	return nil
 }
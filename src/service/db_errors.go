@@ -0,0 +1,98 @@
+package service
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// errorClass tells the runner what to do with the failed delivery
+type errorClass string
+
+const (
+	// errRetryable is a temporary db failure: the message is requeued
+	errRetryable errorClass = "retryable"
+	// errPermanent would fail on every redelivery: the message is dead lettered at once
+	errPermanent errorClass = "permanent"
+	// errUnknown is requeued as before, until max_attempts
+	errUnknown errorClass = "unknown"
+)
+
+// dbError keeps the driver error for classification along with the failed query
+type dbError struct {
+	op    string
+	query string
+	err   error
+}
+
+func newDBError(op string, err error, query string) error {
+	return dbError{op: op, query: query, err: err}
+}
+
+func (e dbError) Error() string {
+	if e.query == "" {
+		return fmt.Sprintf("%s: %s", e.op, e.err.Error())
+	}
+	return fmt.Sprintf("%s: %s, query: %s", e.op, e.err.Error(), e.query)
+}
+
+// permanentError marks the error of the message which would fail the same way
+// on every redelivery, it is dead lettered at once
+type permanentError struct {
+	error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// classifyDBError inspects postgres SQLSTATE of the error
+func classifyDBError(err error) errorClass {
+	switch e := err.(type) {
+	case permanentError:
+		return errPermanent
+	case droppedError:
+		return classifyDBError(e.error)
+	case dbError:
+		return classifyDBError(e.err)
+	case *pq.Error:
+		return classifySQLState(string(e.Code))
+	case net.Error:
+		return errRetryable
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errRetryable
+	}
+	return errUnknown
+}
+
+func classifySQLState(code string) errorClass {
+	switch code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03", // lock_not_available
+		"57014", // query_canceled
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return errRetryable
+	case "23505", // unique_violation
+		"23502", // not_null_violation
+		"22001", // string_data_right_truncation: value too long
+		"22P02": // invalid_text_representation
+		return errPermanent
+	}
+	switch {
+	case strings.HasPrefix(code, "08"), // connection exception
+		strings.HasPrefix(code, "53"): // insufficient resources
+		return errRetryable
+	case strings.HasPrefix(code, "22"), // data exception
+		strings.HasPrefix(code, "23"): // integrity constraint violation
+		return errPermanent
+	}
+	return errUnknown
+}
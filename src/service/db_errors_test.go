@@ -0,0 +1,62 @@
+package service
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifySQLState(t *testing.T) {
+	tests := []struct {
+		code string
+		want errorClass
+	}{
+		{"40001", errRetryable},
+		{"40P01", errRetryable},
+		{"55P03", errRetryable},
+		{"57014", errRetryable},
+		{"57P01", errRetryable},
+		{"57P03", errRetryable},
+		{"08006", errRetryable},
+		{"08001", errRetryable},
+		{"53300", errRetryable},
+		{"23505", errPermanent},
+		{"23502", errPermanent},
+		{"23503", errPermanent},
+		{"22001", errPermanent},
+		{"22P02", errPermanent},
+		{"22003", errPermanent},
+		{"42P01", errUnknown},
+		{"42703", errUnknown},
+		{"", errUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifySQLState(tt.code); got != tt.want {
+			t.Errorf("classifySQLState(%q) = %s, want %s", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"pq", &pq.Error{Code: "23505"}, errPermanent},
+		{"wrapped pq", newDBError("db.Exec", &pq.Error{Code: "40P01"}, "INSERT"), errRetryable},
+		{"dropped", drop(newDBError("db.Exec", &pq.Error{Code: "22001"}, "INSERT")), errPermanent},
+		{"permanent", permanent(errors.New("Retry Keep Days required")), errPermanent},
+		{"bad conn", driver.ErrBadConn, errRetryable},
+		{"eof", newDBError("db.Query", io.ErrUnexpectedEOF, "SELECT"), errRetryable},
+		{"other", errors.New("Retry Keep Days required"), errUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyDBError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyDBError = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
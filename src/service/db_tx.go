@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+)
+
+// dbExecutor is *sql.DB or *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn in a transaction with the isolation level,
+// it is committed before the message is acked
+func withTx(level sql.IsolationLevel, fn func(db dbExecutor) error) (err error) {
+	tx, err := svc.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return newDBError("db.BeginTx", err, "")
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return newDBError("tx.Commit", err, "")
+	}
+	return nil
+}
+
+// inTx runs fn in one transaction when the outbox is enabled, otherwise on svc.db
+func inTx(fn func(db dbExecutor) error) error {
+	if !svc.outbox.enabled() {
+		return fn(svc.db)
+	}
+	return withTx(sql.LevelReadCommitted, fn)
+}
+
+// reportInTx runs fn in a transaction and writes the reporter events it returns
+// to the outbox in the same transaction. Without the outbox the events are
+// returned to be published by the handler
+func reportInTx(level sql.IsolationLevel, fn func(db dbExecutor) ([]reporterEvent, error)) ([]reporterEvent, error) {
+	var reports []reporterEvent
+	err := withTx(level, func(db dbExecutor) (err error) {
+		if reports, err = fn(db); err != nil {
+			return
+		}
+		return svc.outbox.add(db, reports)
+	})
+	if err != nil || svc.outbox.enabled() {
+		return nil, err
+	}
+	return reports, nil
+}
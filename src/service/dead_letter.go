@@ -0,0 +1,198 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	amqp_client "github.com/linkit360/go-utils/amqp"
+)
+
+// failedDeliveriesSize bounds the number of failing messages remembered per queue
+const failedDeliveriesSize = 10000
+
+// deadLetter is published to the dead letter queue
+// when the message failed max_attempts times
+type deadLetter struct {
+	Queue    string    `json:"queue"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+	Body     string    `json:"body"`
+}
+
+// failure is remembered for the requeued message until it succeeds or is dead lettered
+type failure struct {
+	attempts int
+	err      string
+}
+
+// the failed message is requeued by publishing it again with the attempts
+// and the last error in these headers, so the count survives restarts
+// and is seen by every replica consuming the queue
+const (
+	attemptsHeader = "x-qlistener-attempts"
+	errorHeader    = "x-qlistener-error"
+)
+
+// attempts counts failed deliveries of the same message.
+// The count is carried in the headers of the republished message. When it
+// cannot be republished the message is requeued by the broker with the same
+// headers, the attempts since are tracked in memory for the messages with
+// a message id; x-death count is added when the queue is dead lettered by the broker itself
+type attempts struct {
+	max      int
+	queue    string
+	failures *lru
+}
+
+func newAttempts(conf QueueConfig) *attempts {
+	a := &attempts{
+		max:      conf.MaxAttempts,
+		queue:    conf.DeadLetterQueue,
+		failures: newLRU(failedDeliveriesSize),
+	}
+	if a.queue == "" {
+		a.queue = conf.Name + "_dlq"
+	}
+	return a
+}
+
+// deliveryKey identifies the persisted event of the delivery whose publish failed
+func deliveryKey(msg amqp.Delivery) string {
+	if msg.MessageId != "" {
+		return msg.MessageId
+	}
+	sum := sha1.Sum(msg.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+func xDeathCount(headers amqp.Table) int {
+	deaths, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+	count := 0
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if c, ok := death["count"].(int64); ok {
+			count += int(c)
+		}
+	}
+	return count
+}
+
+// headerFailure returns the failure the message has been republished with
+func headerFailure(headers amqp.Table) failure {
+	var f failure
+	switch v := headers[attemptsHeader].(type) {
+	case int64:
+		f.attempts = int(v)
+	case int32:
+		f.attempts = int(v)
+	case int:
+		f.attempts = v
+	}
+	f.err, _ = headers[errorHeader].(string)
+	return f
+}
+
+// seen returns the failure of the message known from the headers. The memory
+// counts the requeues by the broker the headers miss, it is keyed by the message id:
+// distinct messages with the same body must not share the attempts
+func (a *attempts) seen(msg amqp.Delivery) failure {
+	f := headerFailure(msg.Headers)
+	if msg.MessageId == "" {
+		return f
+	}
+	if v, ok := a.failures.Get(msg.MessageId); ok {
+		if known := v.(failure); known.attempts > f.attempts {
+			f = known
+		}
+	}
+	return f
+}
+
+// get returns the failure of the message seen before
+func (a *attempts) get(msg amqp.Delivery) failure {
+	f := a.seen(msg)
+	f.attempts += xDeathCount(msg.Headers)
+	return f
+}
+
+// fail records the failed attempt and reports whether the message is out of attempts
+func (a *attempts) fail(msg amqp.Delivery, err error) (failure, bool) {
+	f := a.seen(msg)
+	f.attempts++
+	f.err = err.Error()
+	if msg.MessageId != "" {
+		a.failures.Add(msg.MessageId, f)
+	}
+
+	f.attempts += xDeathCount(msg.Headers)
+	return f, a.exhausted(f)
+}
+
+func (a *attempts) exhausted(f failure) bool {
+	return a.max > 0 && f.attempts >= a.max
+}
+
+func (a *attempts) forget(msg amqp.Delivery) {
+	if msg.MessageId != "" {
+		a.failures.Remove(msg.MessageId)
+	}
+}
+
+// requeue publishes the message back to the queue with the failure in the headers.
+// x-death is dropped, its count is included in the attempts
+func (a *attempts) requeue(queue string, msg amqp.Delivery, f failure) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		if k != "x-death" {
+			headers[k] = v
+		}
+	}
+	headers[attemptsHeader] = int64(f.attempts)
+	headers[errorHeader] = f.err
+	return svc.publisher.publishMsg(queue, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+}
+
+// deadLetter publishes the message with its error to the dead letter queue
+func (a *attempts) deadLetter(queue string, msg amqp.Delivery, f failure) error {
+	body, err := json.Marshal(amqp_client.EventNotify{
+		EventName: "dead_letter",
+		EventData: deadLetter{
+			Queue:    queue,
+			Error:    f.err,
+			Attempts: f.attempts,
+			FailedAt: time.Now().UTC(),
+			Body:     string(msg.Body),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := svc.publisher.publish(a.queue, body); err != nil {
+		return err
+	}
+	a.forget(msg)
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func testQueueConfig(name string, maxAttempts int) QueueConfig {
+	conf := QueueConfig{MaxAttempts: maxAttempts}
+	conf.Name = name
+	return conf
+}
+
+func TestXDeathCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"no headers", nil, 0},
+		{"no x-death", amqp.Table{attemptsHeader: int64(2)}, 0},
+		{"not a list", amqp.Table{"x-death": "rejected"}, 0},
+		{"one queue", amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "access_campaign", "count": int64(3)},
+		}}, 3},
+		{"several queues", amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "access_campaign", "count": int64(3)},
+			amqp.Table{"queue": "access_campaign_delay", "count": int64(2)},
+		}}, 5},
+		{"bad entries", amqp.Table{"x-death": []interface{}{
+			"rejected",
+			amqp.Table{"queue": "access_campaign"},
+			amqp.Table{"queue": "access_campaign", "count": int64(1)},
+		}}, 1},
+	}
+	for _, tt := range tests {
+		if got := xDeathCount(tt.headers); got != tt.want {
+			t.Errorf("%s: xDeathCount = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttemptsCountsFromHeaders(t *testing.T) {
+	a := newAttempts(testQueueConfig("access_campaign", 3))
+	if a.queue != "access_campaign_dlq" {
+		t.Errorf("dead letter queue = %s", a.queue)
+	}
+	errDB := errors.New("connection refused")
+
+	msg := amqp.Delivery{Body: []byte(`{"tid":"tid-1"}`)}
+	if f, exhausted := a.fail(msg, errDB); f.attempts != 1 || exhausted {
+		t.Fatalf("first fail = %d, %v", f.attempts, exhausted)
+	}
+	// the republished message carries the attempts
+	msg.Headers = amqp.Table{attemptsHeader: int64(1), errorHeader: errDB.Error()}
+	if f := a.get(msg); f.attempts != 1 || f.err != errDB.Error() {
+		t.Fatalf("get = %+v", f)
+	}
+	msg.Headers[attemptsHeader] = int64(2)
+	f, exhausted := a.fail(msg, errDB)
+	if f.attempts != 3 || !exhausted {
+		t.Fatalf("third fail = %d, %v, want exhausted", f.attempts, exhausted)
+	}
+	if !a.exhausted(a.get(amqp.Delivery{Headers: amqp.Table{attemptsHeader: int32(3)}})) {
+		t.Error("int32 header is not counted")
+	}
+}
+
+func TestAttemptsDoNotShareCountByBody(t *testing.T) {
+	a := newAttempts(testQueueConfig("access_campaign", 2))
+	errDB := errors.New("connection refused")
+	body := []byte(`{"tid":"tid-1"}`)
+
+	// the broker requeues the message with the same headers
+	a.fail(amqp.Delivery{Body: body}, errDB)
+	if f := a.get(amqp.Delivery{Body: body}); f.attempts != 0 {
+		t.Errorf("message without id counts %d attempts by body", f.attempts)
+	}
+
+	first := amqp.Delivery{MessageId: "m-1", Body: body}
+	if f, _ := a.fail(first, errDB); f.attempts != 1 {
+		t.Fatalf("fail = %d", f.attempts)
+	}
+	if f := a.get(first); f.attempts != 1 {
+		t.Errorf("requeued by the broker: attempts = %d, want 1", f.attempts)
+	}
+	if f := a.get(amqp.Delivery{MessageId: "m-2", Body: body}); f.attempts != 0 {
+		t.Errorf("other message with the same body: attempts = %d, want 0", f.attempts)
+	}
+	// the broker dead lettering counts too
+	first.Headers = amqp.Table{"x-death": []interface{}{amqp.Table{"count": int64(1)}}}
+	if f, exhausted := a.fail(first, errDB); f.attempts != 3 || !exhausted {
+		t.Errorf("fail with x-death = %d, %v", f.attempts, exhausted)
+	}
+
+	a.forget(first)
+	if f := a.get(amqp.Delivery{MessageId: "m-1", Body: body}); f.attempts != 0 {
+		t.Errorf("forgotten message: attempts = %d", f.attempts)
+	}
+}
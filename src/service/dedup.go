@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+)
+
+const (
+	// dedupConflict relies on the unique key of the table: ON CONFLICT DO NOTHING
+	dedupConflict = "conflict"
+	// dedupMemory remembers written tids in a bounded in-memory set
+	dedupMemory = "memory"
+)
+
+// DedupConfig is the duplicate check of the event type, keyed on the tid.
+// Empty mode writes every redelivered message again. Conflict mode needs
+// the unique key of the conflict target (migrations/0001_unique_tid.sql),
+// otherwise every insert fails
+type DedupConfig struct {
+	Mode string `yaml:"mode"`
+	// ConflictTarget is the unique key of the table, e.g. "(tid)".
+	// Empty target matches any unique key
+	ConflictTarget string `yaml:"conflict_target"`
+	// Size of the in-memory set
+	Size int `yaml:"size" default:"100000"`
+}
+
+type DedupsConfig struct {
+	AccessCampaign   DedupConfig `yaml:"access_campaign"`
+	ContentSent      DedupConfig `yaml:"content_sent"`
+	Transaction      DedupConfig `yaml:"transaction"`
+	PixelTransaction DedupConfig `yaml:"pixel_transaction"`
+}
+
+type dedups struct {
+	AccessCampaign   *dedup
+	ContentSent      *dedup
+	Transaction      *dedup
+	PixelTransaction *dedup
+}
+
+func newDedups(conf DedupsConfig) dedups {
+	return dedups{
+		AccessCampaign:   newDedup("access_campaign", conf.AccessCampaign),
+		ContentSent:      newDedup("content_sent", conf.ContentSent),
+		Transaction:      newDedup("transaction", conf.Transaction),
+		PixelTransaction: newDedup("pixel_transaction", conf.PixelTransaction),
+	}
+}
+
+type dedup struct {
+	event string
+	conf  DedupConfig
+	seen  *lru
+}
+
+func newDedup(event string, conf DedupConfig) *dedup {
+	d := &dedup{
+		event: event,
+		conf:  conf,
+	}
+	if conf.Mode == dedupMemory {
+		d.seen = newLRU(conf.Size)
+	}
+	return d
+}
+
+func (d *dedup) key(tid string) string {
+	return d.event + ":" + tid
+}
+
+// written reports whether the tid has been written already
+func (d *dedup) written(tid string) bool {
+	if d.seen == nil || tid == "" {
+		return false
+	}
+	_, ok := d.seen.Get(d.key(tid))
+	return ok
+}
+
+func (d *dedup) mark(tid string) {
+	if d.seen == nil || tid == "" {
+		return
+	}
+	d.seen.Add(d.key(tid), struct{}{})
+}
+
+// onConflict is appended to the insert query
+func (d *dedup) onConflict() string {
+	if d.conf.Mode != dedupConflict {
+		return ""
+	}
+	if d.conf.ConflictTarget == "" {
+		return " ON CONFLICT DO NOTHING"
+	}
+	return fmt.Sprintf(" ON CONFLICT %s DO NOTHING", d.conf.ConflictTarget)
+}
+
+// insert runs the insert query of the event, it returns false
+// when the event with the same tid has been written before.
+// The tid is marked by the caller once the write is committed
+func (d *dedup) insert(db dbExecutor, tid string, query string, args ...interface{}) (bool, error) {
+	if d.written(tid) {
+		return false, nil
+	}
+	query = query + d.onConflict()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, newDBError("db.Exec", err, query)
+	}
+	if d.conf.Mode == dedupConflict {
+		count, err := res.RowsAffected()
+		if err != nil {
+			return false, newDBError("res.RowsAffected", err, "")
+		}
+		if count == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// GeoIpConfig configures lookups in the database of GeoIpPath
+type GeoIpConfig struct {
+	// CacheSize is how many resolved IPs are kept,
+	// most hits come from a small set of carrier NAT IPs
+	CacheSize int `yaml:"cache_size" default:"10000"`
+	// WatchSeconds is the period of the check for the updated database file,
+	// 0 disables it. SIGHUP reopens the database anyway
+	WatchSeconds int `yaml:"watch_seconds" default:"60"`
+	// OperatorAsn lists the autonomous systems of the operator codes,
+	// hits from other networks are flagged with operator_ip_mismatch
+	OperatorAsn map[int64][]uint `yaml:"operator_asn"`
+}
+
+// geoip failure reasons, other lookup errors are parse errors
+var (
+	errGeoIpEmpty    = errors.New("GeoIP Parse: Empty IP")
+	errGeoIpPrivate  = errors.New("GeoIP Parse: no public IP")
+	errGeoIpNotFound = errors.New("GeoIP Parse: IP not found")
+	errGeoIpParse    = errors.New("GeoIP Parse: invalid IP")
+)
+
+func geoIpFailure(err error) string {
+	switch err {
+	case errGeoIpEmpty:
+		return "empty"
+	case errGeoIpPrivate:
+		return "private"
+	case errGeoIpNotFound:
+		return "not_found"
+	default:
+		return "parse_error"
+	}
+}
+
+// geoDB is the geoip reader with the lookup cache. The reader is reopened
+// when the file is updated: lookups hold the read lock, so the old reader
+// is closed once the in-flight lookups are done
+type geoDB struct {
+	name    string
+	path    string
+	conf    GeoIpConfig
+	resolve func(reader *geoip2.Reader, ip string) (interface{}, error)
+
+	mu      sync.RWMutex
+	reader  *geoip2.Reader
+	cache   *lru
+	modTime time.Time
+	size    int64
+
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func openGeoDB(name, path string, conf GeoIpConfig, resolve func(reader *geoip2.Reader, ip string) (interface{}, error)) (*geoDB, error) {
+	g := &geoDB{
+		name:    name,
+		path:    path,
+		conf:    conf,
+		resolve: resolve,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := g.open(); err != nil {
+		return nil, err
+	}
+	go g.watch()
+	return g, nil
+}
+
+// open replaces the reader and drops the cached lookups of the old one
+func (g *geoDB) open() error {
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	reader, err := geoip2.Open(g.path)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	old := g.reader
+	g.reader = reader
+	g.cache = newLRU(g.conf.CacheSize)
+	g.modTime = fi.ModTime()
+	g.size = fi.Size()
+	g.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// get returns the cached result of the resolve func of the database
+func (g *geoDB) get(ip string) (interface{}, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if v, ok := g.cache.Get(ip); ok {
+		svc.m.GeoIp.db(g.name).CacheHits.Inc()
+		return v, nil
+	}
+	svc.m.GeoIp.db(g.name).CacheMisses.Inc()
+
+	v, err := g.resolve(g.reader, ip)
+	if err != nil {
+		return nil, err
+	}
+	g.cache.Add(ip, v)
+	return v, nil
+}
+
+// cityInfo resolves IpInfo in the GeoLite2-City database
+func cityInfo(reader *geoip2.Reader, ip string) (interface{}, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, errGeoIpParse
+	}
+	record, err := reader.City(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP Parse City: IP: %s: error: %s", ip, err.Error())
+	}
+	// the reader returns an empty record for the IP missing in the database
+	if record.Country.GeoNameID == 0 && record.City.GeoNameID == 0 &&
+		record.Location.Latitude == 0 && record.Location.Longitude == 0 {
+		return nil, errGeoIpNotFound
+	}
+	ipInfo := IpInfo{
+		Ip:                  ip,                         // => 81.2.69.142
+		Country:             record.Country.Names["en"], // => United Kingdom
+		Iso:                 record.Country.IsoCode,     // => GB
+		City:                record.City.Names["en"],    //  => Arnold
+		Timezone:            record.Location.TimeZone,   // => Europe/London
+		Latitude:            record.Location.Latitude,   // => 53
+		Longitude:           record.Location.Longitude,  // => -1.1333
+		MetroCode:           record.Location.MetroCode,
+		AccuracyRadius:      record.Location.AccuracyRadius,
+		PostalCode:          record.Postal.Code, // => NG5
+		IsAnonymousProxy:    record.Traits.IsAnonymousProxy,
+		IsSatelliteProvider: record.Traits.IsSatelliteProvider,
+	}
+	if len(record.Subdivisions) > 0 {
+		ipInfo.Subdivisions = record.Subdivisions[0].Names["en"] // => England
+	}
+	return ipInfo, nil
+}
+
+func (g *geoDB) databaseType() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.reader.Metadata().DatabaseType
+}
+
+// changed reports whether the file differs from the opened one
+func (g *geoDB) changed() bool {
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  g.path,
+			"error": err.Error(),
+		}).Error("geoip stat")
+		return false
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !fi.ModTime().Equal(g.modTime) || fi.Size() != g.size
+}
+
+func (g *geoDB) reload(reason string) {
+	begin := time.Now()
+	if err := g.open(); err != nil {
+		svc.m.GeoIp.db(g.name).ReloadErrors.Inc()
+		log.WithFields(log.Fields{
+			"path":   g.path,
+			"reason": reason,
+			"error":  err.Error(),
+		}).Error("geoip reload, the old database is used")
+		return
+	}
+	svc.m.GeoIp.db(g.name).Reloads.Inc()
+	log.WithFields(log.Fields{
+		"path":   g.path,
+		"reason": reason,
+		"type":   g.databaseType(),
+		"took":   time.Since(begin).String(),
+	}).Info("geoip reloaded")
+}
+
+// watch reopens the database on SIGHUP and when the file is updated
+func (g *geoDB) watch() {
+	defer close(g.done)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if g.conf.WatchSeconds > 0 {
+		ticker := time.NewTicker(time.Duration(g.conf.WatchSeconds) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-g.quit:
+			return
+		case <-hup:
+			g.reload("SIGHUP")
+		case <-tick:
+			if g.changed() {
+				g.reload("file changed")
+			}
+		}
+	}
+}
+
+// Close stops the watch and closes the reader
+func (g *geoDB) Close() error {
+	g.once.Do(func() {
+		close(g.quit)
+	})
+	<-g.done
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reader.Close()
+}
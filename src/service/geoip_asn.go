@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// AsnInfo is the network of the IP from the GeoLite2-ASN or GeoIP2-ISP database
+type AsnInfo struct {
+	Number       uint
+	Organization string
+}
+
+// asnInfo resolves AsnInfo, the ISP database names the network by the ISP
+func asnInfo(reader *geoip2.Reader, ip string) (interface{}, error) {
+	if strings.Contains(reader.Metadata().DatabaseType, "ISP") {
+		record, err := reader.ISP(net.ParseIP(ip))
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP Parse ISP: IP: %s: error: %s", ip, err.Error())
+		}
+		info := AsnInfo{
+			Number:       record.AutonomousSystemNumber,
+			Organization: record.ISP,
+		}
+		if info.Organization == "" {
+			info.Organization = record.AutonomousSystemOrganization
+		}
+		return info, nil
+	}
+
+	record, err := reader.ASN(net.ParseIP(ip))
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP Parse ASN: IP: %s: error: %s", ip, err.Error())
+	}
+	return AsnInfo{
+		Number:       record.AutonomousSystemNumber,
+		Organization: record.AutonomousSystemOrganization,
+	}, nil
+}
+
+func geoAsn(ip string) (AsnInfo, error) {
+	v, err := svc.asnDb.get(ip)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	return v.(AsnInfo), nil
+}
+
+// operatorIpMismatch reports whether the hit comes from a network other than
+// the networks of the operator. Unknown operators and networks are not flagged
+func operatorIpMismatch(operatorCode int64, asn uint) bool {
+	networks, ok := svc.sConfig.GeoIp.OperatorAsn[operatorCode]
+	if !ok || asn == 0 {
+		return false
+	}
+	for _, n := range networks {
+		if n == asn {
+			return false
+		}
+	}
+	return true
+}
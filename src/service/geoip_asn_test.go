@@ -0,0 +1,33 @@
+package service
+
+import "testing"
+
+func TestOperatorIpMismatch(t *testing.T) {
+	saved := svc.sConfig.GeoIp.OperatorAsn
+	defer func() {
+		svc.sConfig.GeoIp.OperatorAsn = saved
+	}()
+	svc.sConfig.GeoIp.OperatorAsn = map[int64][]uint{
+		41001: {8359, 3216},
+		41002: {},
+	}
+
+	tests := []struct {
+		name     string
+		operator int64
+		asn      uint
+		want     bool
+	}{
+		{"network of the operator", 41001, 8359, false},
+		{"other network of the operator", 41001, 3216, false},
+		{"foreign network", 41001, 12389, true},
+		{"unknown network", 41001, 0, false},
+		{"operator without networks", 41002, 8359, true},
+		{"unknown operator", 25002, 8359, false},
+	}
+	for _, tt := range tests {
+		if got := operatorIpMismatch(tt.operator, tt.asn); got != tt.want {
+			t.Errorf("%s: operatorIpMismatch(%d, %d) = %v, want %v", tt.name, tt.operator, tt.asn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGeoIpFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errGeoIpEmpty, "empty"},
+		{errGeoIpPrivate, "private"},
+		{errGeoIpNotFound, "not_found"},
+		{errGeoIpParse, "parse_error"},
+		{errors.New("GeoIP Parse City: IP: 81.2.69.142: error: bad record"), "parse_error"},
+	}
+	for _, tt := range tests {
+		if got := geoIpFailure(tt.err); got != tt.want {
+			t.Errorf("geoIpFailure(%q) = %s, want %s", tt.err.Error(), got, tt.want)
+		}
+	}
+}
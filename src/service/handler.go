@@ -0,0 +1,790 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Handler is implemented by every queue qlistener consumes.
+// The runner owns the delivery: it acks, requeues, logs and updates
+// the common queue metrics, handler only knows how to deal with the event.
+type Handler interface {
+	// Queue returns the queue name, used in logs
+	Queue() string
+	// Metrics returns the queue metrics the runner updates
+	Metrics() *queueMetrics
+	// Decode unmarshals the delivery body
+	Decode(body []byte) (*Event, error)
+	// Validate checks and normalizes the event, an error drops the message
+	Validate(e *Event, logCtx *log.Entry) error
+	// Persist writes the event, an error requeues the message unless it is wrapped with drop()
+	Persist(e *Event) error
+	// Publish notifies the reporter about the persisted event
+	Publish(e *Event) error
+}
+
+// BatchHandler is implemented by handlers able to write several events at once,
+// it is used when batching is enabled for the queue
+type BatchHandler interface {
+	Handler
+	PersistBatch(events []*Event) error
+}
+
+// InsertHandler is implemented by handlers consuming events besides the inserts,
+// the runner counts in the queue add_to_db metrics only the events Inserts reports,
+// the handler keeps the metrics of the others itself
+type InsertHandler interface {
+	Handler
+	Inserts(e *Event) bool
+}
+
+// maxBatchRows keeps the bind parameters of a multi-row insert under the postgres limit
+const maxBatchRows = 1000
+
+// Event is a decoded delivery passed through the handler steps
+type Event struct {
+	Name string
+	Tid  string
+	Data interface{}
+	// Duplicate is set by Persist when the event has been written before,
+	// it is acked without publishing to the reporter
+	Duplicate bool
+}
+
+// errEmptyMessage is returned by Validate when required fields are missing
+var errEmptyMessage = errors.New("Empty message")
+
+// droppedError marks the persist error after which the message must not be requeued
+type droppedError struct {
+	error
+}
+
+func drop(err error) error {
+	return droppedError{err}
+}
+
+// errBatchResize is returned when threads are changed for a queue in batch mode
+var errBatchResize = errors.New("threads cannot be changed in batch mode")
+
+type runner struct {
+	h        Handler
+	conf     QueueConfig
+	batch    BatchConfig
+	backoff  BackoffConfig
+	attempts *attempts
+	errors   *recentErrors
+	// unpublished keeps persisted events whose publish failed,
+	// the redelivered message is only published again
+	unpublished *lru
+
+	mu       sync.Mutex
+	readers  map[<-chan amqp.Delivery]bool
+	stopped  bool
+	stopping chan struct{}
+	inflight sync.WaitGroup
+	active   int
+	// paused runner has onPause closed, running one has onResume closed
+	paused   bool
+	onPause  chan struct{}
+	onResume chan struct{}
+	// threads is the wanted number of workers reading the deliveries channel,
+	// quits of these workers are closed to retire the extra ones
+	threads    int
+	workers    int
+	deliveries <-chan amqp.Delivery
+	quits      []chan struct{}
+	// connected is cleared once the deliveries channel is closed:
+	// the amqp client closes it when the consumer channel is closed
+	connected bool
+}
+
+func newRunner(h Handler, conf QueueConfig) *runner {
+	r := &runner{
+		h:           h,
+		conf:        conf,
+		backoff:     svc.sConfig.Backoff,
+		attempts:    newAttempts(conf),
+		errors:      newRecentErrors(recentErrorsSize),
+		unpublished: newLRU(failedDeliveriesSize),
+		readers:     make(map[<-chan amqp.Delivery]bool),
+		stopping:    make(chan struct{}),
+		onPause:     make(chan struct{}),
+		onResume:    make(chan struct{}),
+		threads:     conf.ThreadsCount,
+	}
+	close(r.onResume)
+	if r.threads < 1 {
+		r.threads = 1
+	}
+	if _, ok := h.(BatchHandler); ok && conf.Batch.Enabled {
+		r.batch = conf.Batch
+		if r.batch.MaxRows <= 0 || r.batch.MaxRows > maxBatchRows {
+			r.batch.MaxRows = maxBatchRows
+		}
+		if r.batch.MaxWaitMs <= 0 {
+			r.batch.MaxWaitMs = 500
+		}
+	} else if conf.Batch.Enabled {
+		log.WithField("q", conf.Name).Warn("batch mode is not supported, disabled")
+	}
+	return r
+}
+
+// consume is passed to amqp.InitConsumer, it is started in every consumer thread
+func (r *runner) consume(deliveries <-chan amqp.Delivery) {
+	if r.batch.Enabled {
+		r.consumeBatch(deliveries)
+		return
+	}
+	quit, ok := r.join(deliveries)
+	if !ok {
+		return
+	}
+	defer r.leave(quit)
+	for r.next(deliveries, quit) {
+	}
+}
+
+// next handles one delivery, it returns false once the runner is stopped,
+// the worker is retired or the channel is closed
+func (r *runner) next(deliveries <-chan amqp.Delivery, quit <-chan struct{}) bool {
+	onPause := r.hold()
+	select {
+	case <-r.stopping:
+		return false
+	case <-quit:
+		return false
+	case <-onPause:
+		return true
+	case msg, ok := <-deliveries:
+		if !ok {
+			r.disconnected(deliveries)
+			return false
+		}
+		if !r.begin() {
+			// not acked message is redelivered by the broker
+			return false
+		}
+		r.handle(msg)
+		r.end()
+		return true
+	}
+}
+
+// hold blocks while the runner is paused or the db breaker is open,
+// it returns the channel closed on the next pause
+func (r *runner) hold() <-chan struct{} {
+	r.mu.Lock()
+	onResume := r.onResume
+	r.mu.Unlock()
+	select {
+	case <-onResume:
+	case <-r.stopping:
+	}
+	svc.breaker.wait(r.stopping)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.onPause
+}
+
+// begin counts the delivery in flight, it returns false once the runner is stopped
+func (r *runner) begin() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.active++
+	r.inflight.Add(1)
+	return true
+}
+
+func (r *runner) end() {
+	r.mu.Lock()
+	r.active--
+	r.mu.Unlock()
+	r.inflight.Done()
+}
+
+// join counts the worker and returns the channel closed to retire it, false when
+// the wanted threads already read the deliveries. The consumer starts the configured
+// threads count on every reconnect, so the first worker of the new deliveries
+// starts the rest of the wanted threads and the extra ones return at once
+func (r *runner) join(deliveries <-chan amqp.Delivery) (chan struct{}, bool) {
+	r.mu.Lock()
+	start := 0
+	if deliveries != r.deliveries {
+		// reconnected: the workers of the closed channel are leaving
+		r.deliveries = deliveries
+		r.connected = true
+		r.quits = nil
+		start = r.threads - 1
+	}
+	if len(r.quits) >= r.threads {
+		r.mu.Unlock()
+		return nil, false
+	}
+	quit := make(chan struct{})
+	r.quits = append(r.quits, quit)
+	r.workers++
+	r.mu.Unlock()
+
+	for i := 0; i < start; i++ {
+		go r.consume(deliveries)
+	}
+	return quit, true
+}
+
+// disconnected marks the closed deliveries channel, a newer one is left as is
+func (r *runner) disconnected(deliveries <-chan amqp.Delivery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if deliveries == r.deliveries {
+		r.connected = false
+	}
+}
+
+func (r *runner) leave(quit chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workers--
+	for i, q := range r.quits {
+		if q == quit {
+			r.quits = append(r.quits[:i], r.quits[i+1:]...)
+			return
+		}
+	}
+}
+
+// pause makes workers to stop taking deliveries until resume,
+// in-flight deliveries are finished
+func (r *runner) pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		return
+	}
+	r.paused = true
+	r.onResume = make(chan struct{})
+	close(r.onPause)
+}
+
+func (r *runner) resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		return
+	}
+	r.paused = false
+	r.onPause = make(chan struct{})
+	close(r.onResume)
+}
+
+// resize changes the number of workers reading the deliveries channel,
+// the extra workers retire without waiting for the next delivery
+func (r *runner) resize(threads int) error {
+	if r.batch.Enabled {
+		return errBatchResize
+	}
+	if threads < 1 {
+		return fmt.Errorf("threads must be positive, got %d", threads)
+	}
+	r.mu.Lock()
+	r.threads = threads
+	for len(r.quits) > threads {
+		last := len(r.quits) - 1
+		close(r.quits[last])
+		r.quits = r.quits[:last]
+	}
+	start := threads - len(r.quits)
+	deliveries := r.deliveries
+	r.mu.Unlock()
+
+	// consumer is not started: the queue is disabled
+	if deliveries == nil {
+		return nil
+	}
+	for i := 0; i < start; i++ {
+		go r.consume(deliveries)
+	}
+	return nil
+}
+
+// stop makes the runner to take no more deliveries
+func (r *runner) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopping)
+	}
+}
+
+// wait waits for in-flight deliveries, it returns false on timeout
+func (r *runner) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// sleep waits for the backoff delay before the message is requeued.
+// It returns at once when the runner is stopped: the message is requeued
+// without the delay, so the drain is not held by the backoff
+func (r *runner) sleep(delay time.Duration) {
+	select {
+	case <-time.After(delay):
+	case <-r.stopping:
+	}
+}
+
+func (r *runner) handle(msg amqp.Delivery) {
+	if r.republish(msg) {
+		return
+	}
+	e, logCtx, ok := r.prepare(msg)
+	if !ok {
+		return
+	}
+	r.process(e, msg, logCtx)
+}
+
+// process persists the prepared event and acks, requeues or dead letters the delivery
+func (r *runner) process(e *Event, msg amqp.Delivery, logCtx *log.Entry) {
+	qm := r.h.Metrics()
+
+	begin := time.Now()
+	err := r.h.Persist(e)
+	svc.breaker.record(err)
+	if err != nil {
+		class := classifyDBError(err)
+		svc.m.Common.DBErrors.Inc(class)
+		if r.inserts(e) {
+			qm.AddToDBErrors.Inc()
+		}
+		logCtx = logCtx.WithField("class", class)
+
+		if _, ok := err.(droppedError); ok {
+			r.errors.add("dropped", e.Tid, err)
+			logCtx.WithFields(log.Fields{
+				"error": err.Error(),
+				"msg":   "dropped",
+			}).Error("failed")
+			ack(msg, false, logCtx)
+			return
+		}
+		f, exhausted := r.attempts.fail(msg, err)
+		if exhausted || class == errPermanent {
+			r.deadLetter(msg, f, logCtx)
+			return
+		}
+		delay := r.backoff.delay(f.attempts)
+		r.errors.add("requeue", e.Tid, err)
+		logCtx.WithFields(log.Fields{
+			"error":    err.Error(),
+			"msg":      "requeue",
+			"attempts": f.attempts,
+			"delay":    delay.String(),
+			"body":     string(msg.Body),
+		}).Error("failed")
+		r.sleep(delay)
+		r.requeue(msg, f, logCtx)
+		return
+	}
+	r.attempts.forget(msg)
+	if e.Duplicate {
+		qm.Duplicates.Inc()
+		logCtx.WithField("msg", "skipped").Info("duplicate")
+		ack(msg, false, logCtx)
+		return
+	}
+	if r.inserts(e) {
+		qm.AddToDbSuccess.Inc()
+		qm.AddToDBDuration.Observe(time.Since(begin).Seconds())
+	}
+	logCtx.WithFields(log.Fields{
+		"took": time.Since(begin).String(),
+	}).Info("success")
+
+	if err := r.publish(e, logCtx); err != nil {
+		f, delay, ok := r.publishFailed(e, msg, err, logCtx)
+		if ok {
+			r.sleep(delay)
+			r.requeue(msg, f, logCtx)
+		}
+		return
+	}
+	ack(msg, false, logCtx)
+}
+
+// inserts tells whether the event is counted in the queue add_to_db metrics
+func (r *runner) inserts(e *Event) bool {
+	if h, ok := r.h.(InsertHandler); ok {
+		return h.Inserts(e)
+	}
+	return true
+}
+
+// republish publishes the event of the redelivered message
+// if it was persisted before, it returns false for other messages
+func (r *runner) republish(msg amqp.Delivery) bool {
+	key := deliveryKey(msg)
+	v, ok := r.unpublished.Get(key)
+	if !ok {
+		return false
+	}
+	e := v.(*Event)
+	logCtx := log.WithFields(log.Fields{
+		"q":     r.h.Queue(),
+		"tid":   e.Tid,
+		"event": e.Name,
+	})
+	if err := r.publish(e, logCtx); err != nil {
+		f, delay, ok := r.publishFailed(e, msg, err, logCtx)
+		if ok {
+			r.sleep(delay)
+			r.requeue(msg, f, logCtx)
+		}
+		return true
+	}
+	r.unpublished.Remove(key)
+	r.attempts.forget(msg)
+	logCtx.Info("republished")
+	ack(msg, false, logCtx)
+	return true
+}
+
+// publishFailed remembers the persisted event to publish it on redelivery.
+// It returns the failure and the delay before the message is requeued,
+// or false when the message is out of attempts and has been dead lettered
+func (r *runner) publishFailed(e *Event, msg amqp.Delivery, err error, logCtx *log.Entry) (failure, time.Duration, bool) {
+	f, exhausted := r.attempts.fail(msg, err)
+	if exhausted {
+		r.unpublished.Remove(deliveryKey(msg))
+		r.deadLetter(msg, f, logCtx)
+		return f, 0, false
+	}
+	r.unpublished.Add(deliveryKey(msg), e)
+	delay := r.backoff.delay(f.attempts)
+	logCtx.WithFields(log.Fields{
+		"msg":      "requeue",
+		"attempts": f.attempts,
+		"delay":    delay.String(),
+	}).Error("publish failed")
+	return f, delay, true
+}
+
+// prepare decodes and validates the delivery, dropped messages are acked here
+func (r *runner) prepare(msg amqp.Delivery) (*Event, *log.Entry, bool) {
+	qm := r.h.Metrics()
+	logCtx := log.WithFields(log.Fields{
+		"q": r.h.Queue(),
+	})
+
+	// message failed max attempts in a batch or was dead lettered by the broker
+	if f := r.attempts.get(msg); r.attempts.exhausted(f) {
+		r.deadLetter(msg, f, logCtx)
+		return nil, logCtx, false
+	}
+
+	e, err := r.h.Decode(msg.Body)
+	if err != nil {
+		qm.Dropped.Inc()
+		r.errors.add("dropped", "", err)
+		logCtx.WithFields(log.Fields{
+			"error": err.Error(),
+			"msg":   "dropped",
+			"body":  string(msg.Body),
+		}).Error("failed")
+		ack(msg, false, logCtx)
+		return nil, logCtx, false
+	}
+	logCtx = logCtx.WithFields(log.Fields{
+		"tid":   e.Tid,
+		"event": e.Name,
+	})
+
+	if err := r.h.Validate(e, logCtx); err != nil {
+		qm.Dropped.Inc()
+		r.errors.add("dropped", e.Tid, err)
+		if err == errEmptyMessage {
+			qm.Empty.Inc()
+		}
+		logCtx.WithFields(log.Fields{
+			"error": err.Error(),
+			"msg":   "dropped",
+			"body":  string(msg.Body),
+		}).Error("discarding")
+		ack(msg, false, logCtx)
+		return nil, logCtx, false
+	}
+	return e, logCtx, true
+}
+
+func (r *runner) deadLetter(msg amqp.Delivery, f failure, logCtx *log.Entry) {
+	logCtx = logCtx.WithFields(log.Fields{
+		"attempts": f.attempts,
+		"error":    f.err,
+		"dlq":      r.attempts.queue,
+	})
+	if err := r.attempts.deadLetter(r.h.Queue(), msg, f); err != nil {
+		svc.m.Common.Errors.Inc()
+		r.errors.add("dead letter", "", err)
+		logCtx.WithField("dlq_error", err.Error()).Error("cannot dead letter, requeue")
+		r.sleep(time.Second)
+		nack(msg, false, logCtx)
+		return
+	}
+	r.h.Metrics().DeadLettered.Inc()
+	r.errors.add("dead lettered", "", errors.New(f.err))
+	logCtx.Error("dead lettered")
+	ack(msg, false, logCtx)
+}
+
+// requeue publishes the failed message back to the queue with the attempts
+// in the headers and acks it. When it cannot be published the broker requeues it,
+// the attempts are counted in memory then
+func (r *runner) requeue(msg amqp.Delivery, f failure, logCtx *log.Entry) {
+	if err := r.attempts.requeue(r.conf.Name, msg, f); err != nil {
+		svc.m.Common.Errors.Inc()
+		logCtx.WithField("requeue_error", err.Error()).Error("cannot republish, nack")
+		nack(msg, false, logCtx)
+		return
+	}
+	ack(msg, false, logCtx)
+}
+
+func (r *runner) publish(e *Event, logCtx *log.Entry) error {
+	err := r.h.Publish(e)
+	if err != nil {
+		svc.m.Common.Errors.Inc()
+		r.errors.add("publish", e.Tid, err)
+		logCtx.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot publish")
+	}
+	return err
+}
+
+// consumeBatch collects deliveries and writes them with one PersistBatch call.
+// The batch is acked or nacked with multiple=true, so only one reader
+// per channel is allowed: other consumer threads return at once
+func (r *runner) consumeBatch(deliveries <-chan amqp.Delivery) {
+	r.mu.Lock()
+	if r.readers[deliveries] {
+		r.mu.Unlock()
+		return
+	}
+	r.readers[deliveries] = true
+	r.workers++
+	r.deliveries = deliveries
+	r.connected = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.readers, deliveries)
+		r.workers--
+		r.mu.Unlock()
+	}()
+
+	var events []*Event
+	var msgs []amqp.Delivery
+	ticker := time.NewTicker(time.Duration(r.batch.MaxWaitMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	// the collected batch is in flight until it is flushed
+	flush := func() {
+		if len(msgs) > 0 {
+			r.flush(events, msgs)
+			r.end()
+		}
+		events, msgs = nil, nil
+	}
+	for {
+		onPause := r.hold()
+		select {
+		case <-r.stopping:
+			flush()
+			return
+		case <-onPause:
+			flush()
+		case msg, ok := <-deliveries:
+			if !ok {
+				// channel is closed: not acked messages are redelivered by the broker
+				r.disconnected(deliveries)
+				if len(msgs) > 0 {
+					r.end()
+				}
+				return
+			}
+			if len(msgs) == 0 && !r.begin() {
+				return
+			}
+			if r.republish(msg) {
+				if len(msgs) == 0 {
+					r.end()
+				}
+				continue
+			}
+			e, _, ok := r.prepare(msg)
+			if !ok {
+				if len(msgs) == 0 {
+					r.end()
+				}
+				continue
+			}
+			events = append(events, e)
+			msgs = append(msgs, msg)
+			if len(events) >= r.batch.MaxRows {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (r *runner) flush(events []*Event, msgs []amqp.Delivery) {
+	last := msgs[len(msgs)-1]
+	qm := r.h.Metrics()
+	logCtx := log.WithFields(log.Fields{
+		"q":    r.h.Queue(),
+		"rows": len(events),
+	})
+
+	svc.breaker.wait(r.stopping)
+	begin := time.Now()
+	err := r.h.(BatchHandler).PersistBatch(events)
+	svc.breaker.record(err)
+	if err != nil {
+		class := classifyDBError(err)
+		svc.m.Common.DBErrors.Inc(class)
+
+		// one bad row fails the whole insert: write rows one by one
+		// to dead letter only the bad ones
+		if class == errPermanent {
+			logCtx.WithFields(log.Fields{
+				"error": err.Error(),
+				"class": class,
+			}).Error("batch failed, retry by row")
+			for i, e := range events {
+				r.process(e, msgs[i], logCtx.WithField("tid", e.Tid))
+			}
+			return
+		}
+		attempts := 0
+		for _, msg := range msgs {
+			qm.AddToDBErrors.Inc()
+			// out of attempts messages are dead lettered once they are redelivered
+			if f, _ := r.attempts.fail(msg, err); f.attempts > attempts {
+				attempts = f.attempts
+			}
+		}
+		delay := r.backoff.delay(attempts)
+		r.errors.add("batch requeue", "", err)
+		logCtx.WithFields(log.Fields{
+			"error":    err.Error(),
+			"class":    class,
+			"msg":      "requeue",
+			"attempts": attempts,
+			"delay":    delay.String(),
+		}).Error("batch failed")
+		r.sleep(delay)
+		nack(last, true, logCtx)
+		return
+	}
+	duplicates := 0
+	for i, msg := range msgs {
+		r.attempts.forget(msg)
+		if events[i].Duplicate {
+			duplicates++
+			qm.Duplicates.Inc()
+			continue
+		}
+		qm.AddToDbSuccess.Inc()
+	}
+	qm.AddToDBDuration.Observe(time.Since(begin).Seconds())
+	logCtx.WithFields(log.Fields{
+		"duplicates": duplicates,
+		"took":       time.Since(begin).String(),
+	}).Info("batch success")
+
+	// failed publishes are settled one by one: the message is requeued
+	// to publish again or dead lettered when it is out of attempts
+	settled := make(map[int]bool)
+	requeue := make(map[int]failure)
+	var delay time.Duration
+	for i, e := range events {
+		if e.Duplicate {
+			continue
+		}
+		eventCtx := logCtx.WithField("tid", e.Tid)
+		if err := r.publish(e, eventCtx); err != nil {
+			settled[i] = true
+			if f, d, ok := r.publishFailed(e, msgs[i], err, eventCtx); ok {
+				requeue[i] = f
+				if d > delay {
+					delay = d
+				}
+			}
+		}
+	}
+	if len(settled) == 0 {
+		ack(last, true, logCtx)
+		return
+	}
+	for i, msg := range msgs {
+		if !settled[i] {
+			ack(msg, false, logCtx)
+		}
+	}
+	if len(requeue) > 0 {
+		r.sleep(delay)
+		for i, f := range requeue {
+			r.requeue(msgs[i], f, logCtx)
+		}
+	}
+}
+
+// ack retries until the channel is closed,
+// after that the broker redelivers the message by itself
+func ack(msg amqp.Delivery, multiple bool, logCtx *log.Entry) {
+	for {
+		err := msg.Ack(multiple)
+		if err == nil || err == amqp.ErrClosed {
+			return
+		}
+		svc.m.Common.Errors.Inc()
+		logCtx.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot ack")
+		time.Sleep(time.Second)
+	}
+}
+
+func nack(msg amqp.Delivery, multiple bool, logCtx *log.Entry) {
+	for {
+		err := msg.Nack(multiple, true)
+		if err == nil || err == amqp.ErrClosed {
+			return
+		}
+		svc.m.Common.Errors.Inc()
+		logCtx.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot nack")
+		time.Sleep(time.Second)
+	}
+}
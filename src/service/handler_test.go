@@ -0,0 +1,131 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// nopHandler is never reached: the tests send no deliveries
+type nopHandler struct{}
+
+func (nopHandler) Queue() string                     { return "test" }
+func (nopHandler) Metrics() *queueMetrics            { return &queueMetrics{} }
+func (nopHandler) Decode([]byte) (*Event, error)     { return &Event{}, nil }
+func (nopHandler) Validate(*Event, *log.Entry) error { return nil }
+func (nopHandler) Persist(*Event) error              { return nil }
+func (nopHandler) Publish(*Event) error              { return nil }
+
+func waitWorkers(t *testing.T, r *runner, want int) {
+	deadline := time.Now().Add(time.Second)
+	for r.info().Workers != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("workers = %d, want %d", r.info().Workers, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// connect starts the configured threads on the deliveries the way the consumer does
+func connect(r *runner) chan amqp.Delivery {
+	deliveries := make(chan amqp.Delivery)
+	for i := 0; i < r.conf.ThreadsCount; i++ {
+		go r.consume(deliveries)
+	}
+	return deliveries
+}
+
+func TestRunnerResize(t *testing.T) {
+	saved := svc
+	defer func() {
+		svc = saved
+	}()
+	svc.breaker = newBreaker(BreakerConfig{})
+
+	conf := testQueueConfig("test", 0)
+	conf.ThreadsCount = 2
+	r := newRunner(nopHandler{}, conf)
+	defer r.stop()
+
+	deliveries := connect(r)
+	waitWorkers(t, r, 2)
+
+	if err := r.resize(4); err != nil {
+		t.Fatalf("resize: %s", err.Error())
+	}
+	waitWorkers(t, r, 4)
+	// idle workers retire without a delivery
+	if err := r.resize(1); err != nil {
+		t.Fatalf("resize: %s", err.Error())
+	}
+	waitWorkers(t, r, 1)
+
+	// the consumer starts the configured threads after a reconnect,
+	// the resized count is kept
+	close(deliveries)
+	deliveries = connect(r)
+	waitWorkers(t, r, 1)
+	time.Sleep(10 * time.Millisecond)
+	waitWorkers(t, r, 1)
+
+	if err := r.resize(3); err != nil {
+		t.Fatalf("resize: %s", err.Error())
+	}
+	waitWorkers(t, r, 3)
+	close(deliveries)
+	connect(r)
+	waitWorkers(t, r, 3)
+	if threads := r.info().Threads; threads != 3 {
+		t.Errorf("threads = %d, want 3", threads)
+	}
+
+	if err := r.resize(0); err == nil {
+		t.Error("resize to 0 threads succeeded")
+	}
+	r.stop()
+	waitWorkers(t, r, 0)
+}
+
+func TestRunnerCheckConnected(t *testing.T) {
+	saved := svc
+	defer func() {
+		svc = saved
+	}()
+	svc.breaker = newBreaker(BreakerConfig{})
+
+	conf := testQueueConfig("test", 0)
+	conf.ThreadsCount = 1
+	r := newRunner(nopHandler{}, conf)
+	if err := r.checkConnected(); err == nil {
+		t.Error("ready before the consumer is started")
+	}
+
+	deliveries := connect(r)
+	waitWorkers(t, r, 1)
+	if err := r.checkConnected(); err != nil {
+		t.Errorf("connected consumer: %s", err.Error())
+	}
+	r.pause()
+	if err := r.checkConnected(); err != nil {
+		t.Errorf("paused consumer: %s", err.Error())
+	}
+	r.resume()
+
+	close(deliveries)
+	waitWorkers(t, r, 0)
+	if err := r.checkConnected(); err == nil || err.Error() != "not connected" {
+		t.Errorf("closed channel: %v", err)
+	}
+	connect(r)
+	waitWorkers(t, r, 1)
+	if err := r.checkConnected(); err != nil {
+		t.Errorf("reconnected consumer: %s", err.Error())
+	}
+
+	r.stop()
+	if err := r.checkConnected(); err == nil || err.Error() != "stopped" {
+		t.Errorf("stopped runner: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthTimeout bounds every readiness check
+const healthTimeout = time.Second
+
+// AddHealthHandler adds /healthz and /readyz for the orchestrator probes.
+// healthz answers while the process is serving, readyz checks the dependencies
+func AddHealthHandler(r *gin.Engine) {
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+}
+
+type componentStatus struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, healthStatus{Status: "ok"})
+}
+
+func readyz(c *gin.Context) {
+	res := healthStatus{
+		Status:     "ok",
+		Components: make(map[string]componentStatus),
+	}
+	check := func(name string, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthTimeout)
+		defer cancel()
+		begin := time.Now()
+		err := fn(ctx)
+		cs := componentStatus{
+			Status:    "ok",
+			LatencyMs: time.Since(begin).Seconds() * 1000,
+		}
+		if err != nil {
+			cs.Status = "fail"
+			cs.Error = err.Error()
+			res.Status = "fail"
+		}
+		res.Components[name] = cs
+	}
+
+	check("db", checkDB)
+	for _, r := range svc.runners {
+		if !r.conf.Enabled {
+			continue
+		}
+		check("consumer:"+r.conf.Name, local(r.checkConnected))
+	}
+	check("publisher", svc.publisher.check)
+	check("geoip", local(checkGeoIp))
+	if svc.asnDb != nil {
+		check("geoip_asn", local(checkGeoIpAsn))
+	}
+	check("uaparser", local(checkUAParser))
+
+	code := http.StatusOK
+	if res.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, res)
+}
+
+// local adapts the checks which do not wait on the network
+func local(fn func() error) func(ctx context.Context) error {
+	return func(context.Context) error {
+		return fn()
+	}
+}
+
+func checkDB(ctx context.Context) error {
+	return svc.db.PingContext(ctx)
+}
+
+// checkConnected reports whether the consumer channel is open: its deliveries
+// are closed with the channel and replaced on reconnect. Paused consumer is ready
+func (r *runner) checkConnected() error {
+	info := r.info()
+	if info.Stopped {
+		return errors.New("stopped")
+	}
+	if !info.Connected {
+		return errors.New("not connected")
+	}
+	return nil
+}
+
+func checkGeoIp() error {
+	if svc.ipDb == nil {
+		return errors.New("not loaded")
+	}
+	if svc.ipDb.databaseType() == "" {
+		return errors.New("no database type in metadata")
+	}
+	return nil
+}
+
+func checkGeoIpAsn() error {
+	if svc.asnDb.databaseType() == "" {
+		return errors.New("no database type in metadata")
+	}
+	return nil
+}
+
+func checkUAParser() error {
+	if svc.uaparser == nil {
+		return errors.New("not loaded")
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,6 +24,9 @@ func newMetrics(name string) Metrics {
 		Pixels:         initPixelMetrics(),
 		UserActions:    initUserActionsMetrics(),
 		Redirects:      initRedirectsMetrics(),
+		ClickHouse:     initClickHouseMetrics(),
+		Publish:        initPublishMetrics(),
+		GeoIp:          initGeoIpMetrics(),
 	}
 	return m
 }
@@ -37,41 +42,117 @@ type Metrics struct {
 	MTManager      *mtManagerMetrics
 	Pixels         *pixelMetrics
 	Redirects      *redirectsMetrics
+	ClickHouse     *clickHouseMetrics
+	Publish        *publishMetrics
+	GeoIp          *geoIpMetrics
 }
 
 type CommonMetrics struct {
 	Errors           m.Gauge
-	DBErrors         m.Gauge
+	DBErrors         dbErrorsMetric
 	DBInsertDuration prometheus.Summary
 	DBUpdateDuration prometheus.Summary
+	BreakerOpen      prometheus.Gauge
+	SinkErrors       m.Gauge
+}
+
+// dbErrorsMetric counts db errors, in total and by the error class
+type dbErrorsMetric struct {
+	m.Gauge
+	classes map[errorClass]m.Gauge
+}
+
+func newDBErrorsMetric() dbErrorsMetric {
+	d := dbErrorsMetric{
+		Gauge:   m.NewGauge("", "", "db_errors", "db errors"),
+		classes: make(map[errorClass]m.Gauge),
+	}
+	for _, class := range []errorClass{errRetryable, errPermanent, errUnknown} {
+		d.classes[class] = m.NewGauge("", "", "db_errors_"+string(class), string(class)+" db errors")
+	}
+	return d
+}
+
+func (d dbErrorsMetric) Inc(class errorClass) {
+	d.Gauge.Inc()
+	d.classes[class].Inc()
+}
+
+func (d dbErrorsMetric) Update() {
+	d.Gauge.Update()
+	for _, g := range d.classes {
+		g.Update()
+	}
+}
+
+func newBreakerOpenGauge() prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: appName,
+		Name:      "db_breaker_open",
+		Help:      "db circuit breaker is open and consumers are paused",
+	})
+	prometheus.MustRegister(g)
+	return g
 }
 
 func initCommonMetrics() *CommonMetrics {
 	cm := &CommonMetrics{
 		Errors:           m.NewGauge("", "", "errors", "errors"),
-		DBErrors:         m.NewGauge("", "", "db_errors", "db errors"),
+		DBErrors:         newDBErrorsMetric(),
 		DBInsertDuration: m.NewSummary(appName+"_insert_db_duration_seconds", "db insert duration seconds"),
 		DBUpdateDuration: m.NewSummary(appName+"_update_db_duration_seconds", "db update duration seconds"),
+		BreakerOpen:      newBreakerOpenGauge(),
+		SinkErrors:       m.NewGauge("", "", "sink_errors", "errors of the sinks after the first one"),
 	}
 
 	go func() {
 		for range time.Tick(time.Minute) {
 			cm.Errors.Update()
 			cm.DBErrors.Update()
+			cm.SinkErrors.Update()
 		}
 	}()
 	return cm
 }
 
+// queueMetrics are updated by the runner for every consumed queue
+type queueMetrics struct {
+	Dropped         m.Gauge
+	Empty           m.Gauge
+	AddToDbSuccess  m.Gauge
+	AddToDBErrors   m.Gauge
+	AddToDBDuration prometheus.Summary
+	DeadLettered    m.Gauge
+	Duplicates      m.Gauge
+}
+
+func newQueueMetrics(newGauge func(name, help string) m.Gauge, name string) queueMetrics {
+	return queueMetrics{
+		Dropped:         newGauge("dropped", "dropped msgs"),
+		Empty:           newGauge("empty", "empty msgs"),
+		AddToDbSuccess:  newGauge("add_to_db_success", "add to db success"),
+		AddToDBErrors:   newGauge("add_to_db_errors", "add to db errors"),
+		AddToDBDuration: newAddToDBDuration(name),
+		DeadLettered:    newGauge("dead_lettered", "dead lettered msgs"),
+		Duplicates:      newGauge("duplicates", "already written msgs"),
+	}
+}
+
+func (qm queueMetrics) update() {
+	qm.Dropped.Update()
+	qm.Empty.Update()
+	qm.AddToDbSuccess.Update()
+	qm.AddToDBErrors.Update()
+	qm.DeadLettered.Update()
+	qm.Duplicates.Update()
+}
+
 // Access Campaign metrics
 type accessCampaignMetrics struct {
-	Dropped          m.Gauge
-	Empty            m.Gauge
-	UnknownHash      m.Gauge
-	ErrorsParseGeoIp m.Gauge
-	AddToDbSuccess   m.Gauge
-	AddToDbDuration  prometheus.Summary
-	AddToDBErrors    m.Gauge
+	queueMetrics
+	UnknownHash        m.Gauge
+	ErrorsParseGeoIp   m.Gauge
+	OperatorIpMismatch m.Gauge
 }
 
 func newAddToDBDuration(name string) prometheus.Summary {
@@ -85,22 +166,17 @@ func newGaugeAccessCampaign(name, help string) m.Gauge {
 }
 func initAccessCampaignMetrics() *accessCampaignMetrics {
 	m := &accessCampaignMetrics{
-		Dropped:          newGaugeAccessCampaign("dropped", "dropped msgs"),
-		Empty:            newGaugeAccessCampaign("empty", "dmpty msgs"),
-		UnknownHash:      newGaugeAccessCampaign("unknown_hash", "dnknown campaign hash"),
-		ErrorsParseGeoIp: newGaugeAccessCampaign("parse_geoip_errors", "parse geoip error"),
-		AddToDbSuccess:   newGaugeAccessCampaign("add_to_db_success", "create access campaign"),
-		AddToDbDuration:  newAddToDBDuration("access_campaign"),
-		AddToDBErrors:    newGaugeAccessCampaign("add_to_db_errors", "access campaign db errors"),
+		queueMetrics:       newQueueMetrics(newGaugeAccessCampaign, "access_campaign"),
+		UnknownHash:        newGaugeAccessCampaign("unknown_hash", "dnknown campaign hash"),
+		ErrorsParseGeoIp:   newGaugeAccessCampaign("parse_geoip_errors", "parse geoip error"),
+		OperatorIpMismatch: newGaugeAccessCampaign("operator_ip_mismatch", "ip not in the networks of the operator"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
+			m.update()
 			m.UnknownHash.Update()
-			m.AddToDbSuccess.Update()
 			m.ErrorsParseGeoIp.Update()
-			m.AddToDBErrors.Update()
+			m.OperatorIpMismatch.Update()
 		}
 	}()
 	return m
@@ -112,27 +188,16 @@ func newGaugeContentSent(name, help string) m.Gauge {
 }
 
 type contentSentMetrics struct {
-	Dropped         m.Gauge
-	Empty           m.Gauge
-	AddToDbSuccess  m.Gauge
-	AddToDBDuration prometheus.Summary
-	AddToDBErrors   m.Gauge
+	queueMetrics
 }
 
 func initContentSentMetrics() *contentSentMetrics {
 	m := &contentSentMetrics{
-		Dropped:         newGaugeContentSent("dropped", "dropped msgs"),
-		Empty:           newGaugeContentSent("empty", "empty msgs"),
-		AddToDbSuccess:  newGaugeContentSent("add_to_db_success", "add to db errors"),
-		AddToDBDuration: newAddToDBDuration("content_sent"),
-		AddToDBErrors:   newGaugeContentSent("add_to_db_errors", "add to db errors"),
+		queueMetrics: newQueueMetrics(newGaugeContentSent, "content_sent"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
 		}
 	}()
 	return m
@@ -144,11 +209,7 @@ func newGaugeUniqueUrls(name, help string) m.Gauge {
 }
 
 type uniqueUrlsMetrics struct {
-	Dropped              m.Gauge
-	Empty                m.Gauge
-	AddToDbSuccess       m.Gauge
-	AddToDBErrors        m.Gauge
-	AddToDBDuration      prometheus.Summary
+	queueMetrics
 	DeleteUniqUrlSuccess m.Gauge
 	DeleteUniqUrlErrors  m.Gauge
 	DeleteFromDBDuration prometheus.Summary
@@ -156,21 +217,14 @@ type uniqueUrlsMetrics struct {
 
 func initUniqueUrlsMetrics() *uniqueUrlsMetrics {
 	m := &uniqueUrlsMetrics{
-		Dropped:              newGaugeUniqueUrls("dropped", "dropped msgs"),
-		Empty:                newGaugeUniqueUrls("empty", "empty msgs"),
-		AddToDbSuccess:       newGaugeUniqueUrls("add_to_db_success", "add to db success"),
-		AddToDBErrors:        newGaugeUniqueUrls("add_to_db_errors", "add to db errors"),
-		AddToDBDuration:      newAddToDBDuration("unique_urls"),
+		queueMetrics:         newQueueMetrics(newGaugeUniqueUrls, "unique_urls"),
 		DeleteUniqUrlSuccess: newGaugeUniqueUrls("delete_from_db_success", "delete from db success"),
 		DeleteUniqUrlErrors:  newGaugeUniqueUrls("delete_from_db_errors", "delete from db errors"),
 		DeleteFromDBDuration: m.NewSummary(appName+"_unique_urls_delete_from_db_duration_seconds", "delete from db unique url duration seconds"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
 		}
 	}()
 	return m
@@ -181,13 +235,18 @@ func newGaugeMTManager(name, help string) m.Gauge {
 }
 
 type mtManagerMetrics struct {
-	Dropped                           m.Gauge
-	Empty                             m.Gauge
-	AddToDbSuccess                    m.Gauge
-	AddToDBErrors                     m.Gauge
-	AddToDBDuration                   prometheus.Summary
+	queueMetrics
 	AddBlacklistedNumberDuration      prometheus.Summary
 	AddPostPaidNumberDuration         prometheus.Summary
+	AddBlacklistedSuccess             m.Gauge
+	AddBlacklistedExisting            m.Gauge
+	AddBlacklistedErrors              m.Gauge
+	AddPostPaidSuccess                m.Gauge
+	AddPostPaidExisting               m.Gauge
+	AddPostPaidErrors                 m.Gauge
+	RemoveBlacklistedNumberDuration   prometheus.Summary
+	RemovePostPaidNumberDuration      prometheus.Summary
+	BlacklistExpiredRows              prometheus.Summary
 	StartRetryDuration                prometheus.Summary
 	TouchRetryDuration                prometheus.Summary
 	RemoveRetryDuration               prometheus.Summary
@@ -196,21 +255,36 @@ type mtManagerMetrics struct {
 	UnsubscribeDuration               prometheus.Summary
 	UnsubscribeAllDuration            prometheus.Summary
 	WriteTransactionDuration          prometheus.Summary
+	RejectedTransitions               m.Gauge
+	BulkUnsubscribedRows              prometheus.Summary
+	BulkUnsubscribeDuration           prometheus.Summary
+	RetriesSweptRows                  prometheus.Summary
+	RetriesSweepDuration              prometheus.Summary
 }
 
 func newDuration(name string) prometheus.Summary {
 	return m.NewSummary(appName+"_"+name+"_duration_seconds", name)
 }
 
+// newRows observes the rows handled at once, its sum is the total
+func newRows(name string) prometheus.Summary {
+	return m.NewSummary(appName+"_"+name+"_rows", name+" rows")
+}
+
 func initMtManagerMetrics() *mtManagerMetrics {
 	m := &mtManagerMetrics{
-		Dropped:                           newGaugeMTManager("dropped", "dropped msgs"),
-		Empty:                             newGaugeMTManager("empty", "empty msgs"),
-		AddToDbSuccess:                    newGaugeMTManager("add_to_db_success", "add to db success"),
-		AddToDBErrors:                     newGaugeMTManager("add_to_db_errors", "add to db errors"),
-		AddToDBDuration:                   newAddToDBDuration("mt_manager_db"),
+		queueMetrics:                      newQueueMetrics(newGaugeMTManager, "mt_manager_db"),
 		AddBlacklistedNumberDuration:      newDuration("add_blacklisted_db"),
 		AddPostPaidNumberDuration:         newDuration("add_postpaid_db"),
+		AddBlacklistedSuccess:             newGaugeMTManager("add_blacklisted_success", "numbers blacklisted"),
+		AddBlacklistedExisting:            newGaugeMTManager("add_blacklisted_existing", "numbers blacklisted before"),
+		AddBlacklistedErrors:              newGaugeMTManager("add_blacklisted_errors", "add blacklisted errors"),
+		AddPostPaidSuccess:                newGaugeMTManager("add_postpaid_success", "numbers added to postpaid"),
+		AddPostPaidExisting:               newGaugeMTManager("add_postpaid_existing", "numbers added to postpaid before"),
+		AddPostPaidErrors:                 newGaugeMTManager("add_postpaid_errors", "add postpaid errors"),
+		RemoveBlacklistedNumberDuration:   newDuration("remove_blacklisted_db"),
+		RemovePostPaidNumberDuration:      newDuration("remove_postpaid_db"),
+		BlacklistExpiredRows:              newRows("blacklist_expired"),
 		StartRetryDuration:                newDuration("start_retry_db"),
 		TouchRetryDuration:                newDuration("touch_retry_db"),
 		RemoveRetryDuration:               newDuration("remove_retry_db"),
@@ -219,13 +293,22 @@ func initMtManagerMetrics() *mtManagerMetrics {
 		UnsubscribeDuration:               newDuration("unsubscribe"),
 		UnsubscribeAllDuration:            newDuration("unsubscribe_all"),
 		WriteTransactionDuration:          newDuration("write_transaction_db"),
+		RejectedTransitions:               newGaugeMTManager("rejected_transitions", "subscription result changes rejected"),
+		BulkUnsubscribedRows:              newRows("bulk_unsubscribed"),
+		BulkUnsubscribeDuration:           newDuration("bulk_unsubscribe"),
+		RetriesSweptRows:                  newRows("retries_swept"),
+		RetriesSweepDuration:              newDuration("retries_sweep"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
+			m.AddBlacklistedSuccess.Update()
+			m.AddBlacklistedExisting.Update()
+			m.AddBlacklistedErrors.Update()
+			m.AddPostPaidSuccess.Update()
+			m.AddPostPaidExisting.Update()
+			m.AddPostPaidErrors.Update()
+			m.RejectedTransitions.Update()
 		}
 	}()
 	return m
@@ -237,27 +320,16 @@ func newGaugeUserActions(name, help string) m.Gauge {
 }
 
 type userActionsMetrics struct {
-	Dropped         m.Gauge
-	Empty           m.Gauge
-	AddToDbSuccess  m.Gauge
-	AddToDBDuration prometheus.Summary
-	AddToDBErrors   m.Gauge
+	queueMetrics
 }
 
 func initUserActionsMetrics() *userActionsMetrics {
 	m := &userActionsMetrics{
-		Dropped:         newGaugeUserActions("dropped", "dropped msgs"),
-		Empty:           newGaugeUserActions("empty", "empty msgs"),
-		AddToDbSuccess:  newGaugeUserActions("add_to_db_success", "create records count"),
-		AddToDBDuration: newAddToDBDuration("user_actions"),
-		AddToDBErrors:   newGaugeUserActions("add_to_db_errors", "create record: database errors"),
+		queueMetrics: newQueueMetrics(newGaugeUserActions, "user_actions"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
 		}
 	}()
 	return m
@@ -269,27 +341,16 @@ func newGaugeOperator(name, help string) m.Gauge {
 }
 
 type operatorMetrics struct {
-	Dropped         m.Gauge
-	Empty           m.Gauge
-	AddToDbSuccess  m.Gauge
-	AddToDBDuration prometheus.Summary
-	AddToDBErrors   m.Gauge
+	queueMetrics
 }
 
 func initOperatorsMetrics() *operatorMetrics {
 	m := &operatorMetrics{
-		Dropped:         newGaugeOperator("dropped", "dropped msgs"),
-		Empty:           newGaugeOperator("empty", "empty msgs"),
-		AddToDbSuccess:  newGaugeOperator("add_to_db_success", "create records count"),
-		AddToDBDuration: newAddToDBDuration("operator_transactions"),
-		AddToDBErrors:   newGaugeOperator("add_to_db_errors", "create record: database errors"),
+		queueMetrics: newQueueMetrics(newGaugeOperator, "operator_transactions"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
 		}
 	}()
 	return m
@@ -301,43 +362,38 @@ func newGaugePixels(name, help string) m.Gauge {
 }
 
 type pixelMetrics struct {
-	Dropped                      m.Gauge
-	Empty                        m.Gauge
-	AddToDbSuccess               m.Gauge
-	AddToDBDuration              prometheus.Summary
-	AddToDBErrors                m.Gauge
+	queueMetrics
 	UpdateSubscriptionSuccess    m.Gauge
 	UpdateDBDuration             prometheus.Summary
 	UpdateSubscriptionToDBErrors m.Gauge
 	BufferAddToDbSuccess         m.Gauge
 	BufferAddToDBDuration        prometheus.Summary
 	BufferAddToDBErrors          m.Gauge
+	RemoveBufferedSuccess        m.Gauge
+	RemoveBufferedErrors         m.Gauge
 }
 
 func initPixelMetrics() *pixelMetrics {
 	m := &pixelMetrics{
-		Dropped:                      newGaugePixels("dropped", "dropped msgs"),
-		Empty:                        newGaugePixels("empty", "empty msgs"),
-		AddToDbSuccess:               newGaugePixels("add_to_db_success", "create records count"),
-		AddToDBDuration:              newAddToDBDuration("pixel_transactions"),
-		AddToDBErrors:                newGaugePixels("add_to_db_errors", "create record: database errors"),
+		queueMetrics:                 newQueueMetrics(newGaugePixels, "pixel_transactions"),
 		UpdateSubscriptionSuccess:    newGaugePixels("update_subscriptions_db_success", "pixels: update subscriptions success"),
 		UpdateDBDuration:             newUpdateDBDuration("subscription_pixel_sent"),
 		UpdateSubscriptionToDBErrors: newGaugePixels("update_subscriptions_db_errors", "pixels: update subscriptions errors"),
 		BufferAddToDbSuccess:         newGaugePixels("pixel_buffer_dropped", "buffer dropped msgs"),
 		BufferAddToDBDuration:        newAddToDBDuration("pixel_buffer"),
 		BufferAddToDBErrors:          newGaugePixels("pixel_buffer_db_errors", "pixel buffer db errors msgs"),
+		RemoveBufferedSuccess:        newGaugePixels("pixel_buffer_removed", "buffer removed msgs"),
+		RemoveBufferedErrors:         newGaugePixels("pixel_buffer_remove_errors", "pixel buffer remove errors msgs"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
-			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.update()
 			m.UpdateSubscriptionSuccess.Update()
 			m.UpdateSubscriptionToDBErrors.Update()
 			m.BufferAddToDbSuccess.Update()
 			m.BufferAddToDBErrors.Update()
+			m.RemoveBufferedSuccess.Update()
+			m.RemoveBufferedErrors.Update()
 		}
 	}()
 	return m
@@ -349,28 +405,172 @@ func newGaugeRedirects(name, help string) m.Gauge {
 }
 
 type redirectsMetrics struct {
-	Dropped         m.Gauge
-	Empty           m.Gauge
-	AddToDbSuccess  m.Gauge
-	AddToDBDuration prometheus.Summary
-	AddToDBErrors   m.Gauge
+	queueMetrics
 }
 
 func initRedirectsMetrics() *redirectsMetrics {
 	m := &redirectsMetrics{
-		Dropped:         newGaugeRedirects("dropped", "dropped msgs"),
-		Empty:           newGaugeRedirects("empty", "empty msgs"),
-		AddToDbSuccess:  newGaugeRedirects("add_to_db_success", "create records count"),
-		AddToDBDuration: newAddToDBDuration("redirects"),
-		AddToDBErrors:   newGaugeRedirects("add_to_db_errors", "create record: database errors"),
+		queueMetrics: newQueueMetrics(newGaugeRedirects, "redirects"),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			m.update()
+		}
+	}()
+	return m
+}
+
+// clickhouse sink metrics
+func newGaugeClickHouse(name, help string) m.Gauge {
+	return m.NewGauge(appName, "clickhouse", name, "clickhouse "+help)
+}
+
+type clickHouseMetrics struct {
+	Dropped        m.Gauge
+	Errors         m.Gauge
+	Rows           prometheus.Summary
+	Lost           prometheus.Summary
+	InsertDuration prometheus.Summary
+}
+
+func initClickHouseMetrics() *clickHouseMetrics {
+	m := &clickHouseMetrics{
+		Dropped:        newGaugeClickHouse("dropped", "rows dropped on full buffer"),
+		Errors:         newGaugeClickHouse("errors", "insert errors"),
+		Rows:           newRows("clickhouse_inserted"),
+		Lost:           newRows("clickhouse_lost"),
+		InsertDuration: m.NewSummary(appName+"_clickhouse_insert_duration_seconds", "clickhouse insert duration seconds"),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
 			m.Dropped.Update()
-			m.Empty.Update()
-			m.AddToDbSuccess.Update()
-			m.AddToDBErrors.Update()
+			m.Errors.Update()
 		}
 	}()
 	return m
 }
+
+// publishMetrics are kept per queue: reporter hit, pixel, transaction,
+// outflow and the dead letter queues. They are created on the first publish
+type publishMetrics struct {
+	mu     sync.Mutex
+	queues map[string]*queuePublishMetrics
+}
+
+type queuePublishMetrics struct {
+	Success         m.Gauge
+	Failed          m.Gauge
+	ConfirmDuration prometheus.Summary
+}
+
+func initPublishMetrics() *publishMetrics {
+	pm := &publishMetrics{
+		queues: make(map[string]*queuePublishMetrics),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			pm.mu.Lock()
+			for _, q := range pm.queues {
+				q.Success.Update()
+				q.Failed.Update()
+			}
+			pm.mu.Unlock()
+		}
+	}()
+	return pm
+}
+
+// metricName replaces the characters of the queue name not allowed in metric names
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (pm *publishMetrics) queue(name string) *queuePublishMetrics {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if q, ok := pm.queues[name]; ok {
+		return q
+	}
+	prefix := metricName(name)
+	q := &queuePublishMetrics{
+		Success:         m.NewGauge(appName, "publish", prefix+"_success", "publish "+name+" confirmed"),
+		Failed:          m.NewGauge(appName, "publish", prefix+"_failed", "publish "+name+" failed or not confirmed"),
+		ConfirmDuration: m.NewSummary(appName+"_publish_"+prefix+"_confirm_duration_seconds", "publish "+name+" confirm duration seconds"),
+	}
+	pm.queues[name] = q
+	return q
+}
+
+func (pm *publishMetrics) observe(queue string, begin time.Time, err error) {
+	q := pm.queue(queue)
+	if err != nil {
+		q.Failed.Inc()
+		return
+	}
+	q.Success.Inc()
+	q.ConfirmDuration.Observe(time.Since(begin).Seconds())
+}
+
+// geoip lookup cache and database reload metrics
+func newGaugeGeoIp(name, help string) m.Gauge {
+	return m.NewGauge(appName, "geoip", name, "geoip "+help)
+}
+
+// geoIpMetrics are kept per database: city or asn,
+// failures of the hits per reason: see geoIpFailure
+type geoIpMetrics struct {
+	dbs      map[string]*geoIpDBMetrics
+	failures map[string]m.Gauge
+}
+
+type geoIpDBMetrics struct {
+	CacheHits    m.Gauge
+	CacheMisses  m.Gauge
+	Reloads      m.Gauge
+	ReloadErrors m.Gauge
+}
+
+func initGeoIpMetrics() *geoIpMetrics {
+	gm := &geoIpMetrics{
+		dbs:      make(map[string]*geoIpDBMetrics),
+		failures: make(map[string]m.Gauge),
+	}
+	for _, db := range []string{"city", "asn"} {
+		gm.dbs[db] = &geoIpDBMetrics{
+			CacheHits:    newGaugeGeoIp(db+"_cache_hits", db+" lookups found in the cache"),
+			CacheMisses:  newGaugeGeoIp(db+"_cache_misses", db+" lookups in the database"),
+			Reloads:      newGaugeGeoIp(db+"_reloads", db+" database reloads"),
+			ReloadErrors: newGaugeGeoIp(db+"_reload_errors", db+" failed database reloads"),
+		}
+	}
+	for _, reason := range []string{"empty", "private", "not_found", "parse_error"} {
+		gm.failures[reason] = newGaugeGeoIp("failures_"+reason, "hits without geoip data: "+reason)
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			for _, db := range gm.dbs {
+				db.CacheHits.Update()
+				db.CacheMisses.Update()
+				db.Reloads.Update()
+				db.ReloadErrors.Update()
+			}
+			for _, g := range gm.failures {
+				g.Update()
+			}
+		}
+	}()
+	return gm
+}
+
+func (gm *geoIpMetrics) db(name string) *geoIpDBMetrics {
+	return gm.dbs[name]
+}
+
+func (gm *geoIpMetrics) failure(reason string) m.Gauge {
+	return gm.failures[reason]
+}
@@ -3,8 +3,9 @@ package service
 import (
 	"database/sql"
 	"encoding/json"
+	"net"
+	"time"
 
-	"github.com/oschwald/geoip2-golang"
 	log "github.com/sirupsen/logrus"
 	amqp_driver "github.com/streadway/amqp"
 	"github.com/ua-parser/uap-go/uaparser"
@@ -20,7 +21,7 @@ var svc Service
 
 type Service struct {
 	db                         *sql.DB
-	n                          *amqp.Notifier
+	publisher                  *publisher
 	consumer                   Consumers
 	contentSentChan            <-chan amqp_driver.Delivery
 	uniqueUrlsChan             <-chan amqp_driver.Delivery
@@ -30,7 +31,15 @@ type Service struct {
 	mtManagerChan              <-chan amqp_driver.Delivery
 	pixelsChan                 <-chan amqp_driver.Delivery
 	redirectsChan              <-chan amqp_driver.Delivery
-	ipDb                       *geoip2.Reader
+	breaker                    *breaker
+	dedup                      dedups
+	sinks                      sinks
+	outbox                     *outbox
+	sweepers                   []*sweeper
+	runners                    []*runner
+	ipDb                       *geoDB
+	asnDb                      *geoDB
+	trustedProxies             []*net.IPNet
 	uaparser                   *uaparser.Parser
 	sConfig                    ServiceConfig
 	dbConf                     db.DataBaseConfig
@@ -38,11 +47,26 @@ type Service struct {
 }
 
 type ServiceConfig struct {
-	GeoIpPath              string       `yaml:"geoip_path" default:"dev/GeoLite2-City.mmdb"`
-	UAParserRegexesPath    string       `default:"/home/centos/linkit/regexes.yaml" yaml:"ua_parser_regexes_path"`
-	PixelBufferTimoutHours int          `yaml:"pixel_buffer_timeout_hours" default:"24"`
-	UniqueUrlsCleanupDays  int          `yaml:"unique_urls_cleanup_days" default:"2"`
-	Queue                  QueuesConfig `yaml:"queues"`
+	GeoIpPath              string                `yaml:"geoip_path" default:"dev/GeoLite2-City.mmdb"`
+	GeoIpAsnPath           string                `yaml:"geoip_asn_path"` // optional GeoLite2-ASN or GeoIP2-ISP database
+	GeoIp                  GeoIpConfig           `yaml:"geoip"`
+	TrustedProxies         []string              `yaml:"trusted_proxies"` // CIDRs of our proxies in X-Forwarded-For
+	UAParserRegexesPath    string                `default:"/home/centos/linkit/regexes.yaml" yaml:"ua_parser_regexes_path"`
+	PixelBufferTimoutHours int                   `yaml:"pixel_buffer_timeout_hours" default:"24"`
+	UniqueUrlsCleanupDays  int                   `yaml:"unique_urls_cleanup_days" default:"2"`
+	ShutdownTimeoutSeconds int                   `yaml:"shutdown_timeout_seconds" default:"8"`
+	Backoff                BackoffConfig         `yaml:"backoff"`
+	Breaker                BreakerConfig         `yaml:"breaker"`
+	Dedup                  DedupsConfig          `yaml:"dedup"`
+	Sinks                  SinksConfig           `yaml:"sinks"`
+	Outbox                 OutboxConfig          `yaml:"outbox"`
+	Transitions            TransitionsConfig     `yaml:"transitions"`
+	History                HistoryConfig         `yaml:"history"`
+	Blacklist              BlacklistConfig       `yaml:"blacklist"`
+	BulkUnsubscribe        BulkUnsubscribeConfig `yaml:"bulk_unsubscribe"`
+	Retries                RetriesConfig         `yaml:"retries"`
+	Publisher              PublisherConfig       `yaml:"publisher"`
+	Queue                  QueuesConfig          `yaml:"queues"`
 }
 
 type Consumers struct {
@@ -57,18 +81,45 @@ type Consumers struct {
 }
 
 type QueuesConfig struct {
-	AccessCampaign config.ConsumeQueueConfig `yaml:"access_campaign"`
-	ContentSent    config.ConsumeQueueConfig `yaml:"content_sent"`
-	UniqueUrls     config.ConsumeQueueConfig `yaml:"unique_urls"`
-	UserActions    config.ConsumeQueueConfig `yaml:"user_actions"`
-	TransactionLog config.ConsumeQueueConfig `yaml:"transaction_log"`
-	MTManager      config.ConsumeQueueConfig `yaml:"mt_manager"`
-	PixelSent      config.ConsumeQueueConfig `yaml:"pixel_sent"`
-	Redirects      config.ConsumeQueueConfig `yaml:"redirect"`
-	Hit            string                    `yaml:"reporter_hit"`
-	Pixel          string                    `yaml:"reporter_pixel"`
-	Transaction    string                    `yaml:"reporter_transaction"`
-	Outflow        string                    `yaml:"reporter_outflow"`
+	AccessCampaign QueueConfig `yaml:"access_campaign"`
+	ContentSent    QueueConfig `yaml:"content_sent"`
+	UniqueUrls     QueueConfig `yaml:"unique_urls"`
+	UserActions    QueueConfig `yaml:"user_actions"`
+	TransactionLog QueueConfig `yaml:"transaction_log"`
+	MTManager      QueueConfig `yaml:"mt_manager"`
+	PixelSent      QueueConfig `yaml:"pixel_sent"`
+	Redirects      QueueConfig `yaml:"redirect"`
+	Hit            string      `yaml:"reporter_hit"`
+	Pixel          string      `yaml:"reporter_pixel"`
+	Transaction    string      `yaml:"reporter_transaction"`
+	Outflow        string      `yaml:"reporter_outflow"`
+	// Blocked receives the newly blacklisted and postpaid numbers, empty disables it
+	Blocked string `yaml:"reporter_blocked"`
+}
+
+// QueueConfig is the consumer queue config with qlistener specific options
+type QueueConfig struct {
+	config.ConsumeQueueConfig `yaml:",inline"`
+	Batch                     BatchConfig `yaml:"batch"`
+	// MaxAttempts is how many times the message is requeued before
+	// it is sent to the dead letter queue, 0 means requeue forever
+	MaxAttempts     int    `yaml:"max_attempts"`
+	DeadLetterQueue string `yaml:"dead_letter_queue"`
+	// Sinks are names of the sinks the events are written to, postgres by default.
+	// Only the first one requeues the message on error, the others are best effort.
+	// Ignored for queues updating state: unique_urls, pixel updates and mt_manager tasks
+	// other than WriteTransaction
+	Sinks []string `yaml:"sinks"`
+}
+
+// BatchConfig enables writing several deliveries with one statement.
+// Rows are flushed when max_rows are collected or max_wait_ms passed,
+// so keep prefetch_count not less than max_rows.
+// Only queues with a BatchHandler support it
+type BatchConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxRows   int  `yaml:"max_rows" default:"100"`
+	MaxWaitMs int  `yaml:"max_wait_ms" default:"500"`
 }
 
 func InitService(
@@ -87,13 +138,29 @@ func InitService(
 	svc.sConfig = sConf
 	svc.dbConf = dbConf
 
+	svc.m = newMetrics(appName)
+
 	var err error
-	svc.ipDb, err = geoip2.Open(sConf.GeoIpPath)
+	svc.trustedProxies, err = parseCIDRs(sConf.TrustedProxies)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("trusted proxies")
+	}
+	svc.ipDb, err = openGeoDB("city", sConf.GeoIpPath, sConf.GeoIp, cityInfo)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Fatal("geoip init")
 	}
+	if sConf.GeoIpAsnPath != "" {
+		svc.asnDb, err = openGeoDB("asn", sConf.GeoIpAsnPath, sConf.GeoIp, asnInfo)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatal("geoip asn init")
+		}
+	}
 	svc.uaparser, err = uaparser.New(sConf.UAParserRegexesPath)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -101,36 +168,97 @@ func InitService(
 		}).Fatal("User Agent Parser init")
 	}
 
-	svc.n = amqp.NewNotifier(notifierConfig)
+	svc.publisher = newPublisher(notifierConfig.Conn, sConf.Publisher)
 
-	svc.m = newMetrics(appName)
+	svc.breaker = newBreaker(sConf.Breaker)
+	svc.dedup = newDedups(sConf.Dedup)
+	svc.sinks = newSinks(sConf)
+	svc.outbox = newOutbox(sConf.Outbox)
+	svc.sweepers = append(svc.sweepers,
+		newBlacklistSweeper(sConf.Blacklist),
+		newRetriesSweeper(sConf.Retries),
+	)
 
 	svc.consumer = Consumers{
-		Access:      amqp.InitConsumer(consumerConf, sConf.Queue.AccessCampaign, svc.accessCampaignChan, processAccessCampaign),
-		UserActions: amqp.InitConsumer(consumerConf, sConf.Queue.UserActions, svc.userActionsChan, processUserActions),
-		ContentSent: amqp.InitConsumer(consumerConf, sConf.Queue.ContentSent, svc.contentSentChan, processContentSent),
-		UniqueUrl:   amqp.InitConsumer(consumerConf, sConf.Queue.UniqueUrls, svc.uniqueUrlsChan, processUniqueUrls),
-		Operator:    amqp.InitConsumer(consumerConf, sConf.Queue.TransactionLog, svc.operatorTransactionLogChan, operatorTransactions),
-		MTManager:   amqp.InitConsumer(consumerConf, sConf.Queue.MTManager, svc.mtManagerChan, processMTManagerTasks),
-		Pixels:      amqp.InitConsumer(consumerConf, sConf.Queue.PixelSent, svc.pixelsChan, processPixels),
-		Redirects:   amqp.InitConsumer(consumerConf, sConf.Queue.Redirects, svc.redirectsChan, processRedirects),
+		Access:      initConsumer(consumerConf, sConf.Queue.AccessCampaign, svc.accessCampaignChan, accessCampaignHandler{}),
+		UserActions: initConsumer(consumerConf, sConf.Queue.UserActions, svc.userActionsChan, userActionsHandler{}),
+		ContentSent: initConsumer(consumerConf, sConf.Queue.ContentSent, svc.contentSentChan, contentSentHandler{}),
+		UniqueUrl:   initConsumer(consumerConf, sConf.Queue.UniqueUrls, svc.uniqueUrlsChan, uniqueUrlsHandler{}),
+		Operator:    initConsumer(consumerConf, sConf.Queue.TransactionLog, svc.operatorTransactionLogChan, operatorHandler{}),
+		MTManager:   initConsumer(consumerConf, sConf.Queue.MTManager, svc.mtManagerChan, mtManagerHandler{}),
+		Pixels:      initConsumer(consumerConf, sConf.Queue.PixelSent, svc.pixelsChan, pixelsHandler{}),
+		Redirects:   initConsumer(consumerConf, sConf.Queue.Redirects, svc.redirectsChan, redirectsHandler{}),
 	}
 }
 
-func publishReporter(queue string, c mid.Collect) (err error) {
+func initConsumer(
+	consumerConf amqp.ConsumerConfig,
+	queueConf QueueConfig,
+	ch <-chan amqp_driver.Delivery,
+	h Handler,
+) *amqp.Consumer {
+	r := newRunner(h, queueConf)
+	svc.runners = append(svc.runners, r)
+	return amqp.InitConsumer(consumerConf, queueConf.ConsumeQueueConfig, ch, r.consume)
+}
+
+// Shutdown stops consumers from taking new deliveries, waits for
+// in-flight ones up to the timeout and closes db and geoip
+func Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	log.WithField("timeout", timeout.String()).Info("shutdown")
+
+	for _, r := range svc.runners {
+		r.stop()
+	}
+	for _, r := range svc.runners {
+		if !r.wait(time.Until(deadline)) {
+			log.WithField("q", r.h.Queue()).Error("shutdown: in-flight deliveries left")
+		}
+	}
+	svc.outbox.stop()
+	for _, s := range svc.sweepers {
+		s.stop()
+	}
+	svc.sinks.close()
+	if err := svc.publisher.close(); err != nil {
+		log.WithField("error", err.Error()).Error("shutdown: close publisher")
+	}
+
+	if err := svc.db.Close(); err != nil {
+		log.WithField("error", err.Error()).Error("shutdown: close db")
+	}
+	if err := svc.ipDb.Close(); err != nil {
+		log.WithField("error", err.Error()).Error("shutdown: close geoip")
+	}
+	if svc.asnDb != nil {
+		if err := svc.asnDb.Close(); err != nil {
+			log.WithField("error", err.Error()).Error("shutdown: close geoip asn")
+		}
+	}
+	log.Info("shutdown done")
+}
+
+// reporterEvent is the collect sent to the reporter queue once the event is persisted
+type reporterEvent struct {
+	queue   string
+	collect mid.Collect
+}
+
+func reporterBody(c mid.Collect) ([]byte, error) {
 	event := amqp.EventNotify{
 		EventName: "ee",
 		EventData: c,
 	}
+	return json.Marshal(event)
+}
+
+func publishReporter(queue string, c mid.Collect) (err error) {
 	var body []byte
-	body, err = json.Marshal(event)
+	body, err = reporterBody(c)
 
 	if err != nil {
 		return
 	}
-	svc.n.Publish(amqp.AMQPMessage{
-		QueueName: queue,
-		Body:      body,
-	})
-	return nil
+	return svc.publisher.publish(queue, body)
 }
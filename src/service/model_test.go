@@ -0,0 +1,14 @@
+package service
+
+import (
+	"sync"
+)
+
+var testMetricsOnce sync.Once
+
+// initTestMetrics registers the metrics once for all the tests of the package
+func initTestMetrics() {
+	testMetricsOnce.Do(func() {
+		svc.m = newMetrics("qlistener_test")
+	})
+}
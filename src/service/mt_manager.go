@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	mid "github.com/linkit360/go-mid/service"
 	rec "github.com/linkit360/go-utils/rec"
@@ -18,113 +18,156 @@ type EventNotifyRec struct {
 	EventData rec.Record `json:"event_data,omitempty"`
 }
 
-func processMTManagerTasks(deliveries <-chan amqp.Delivery) {
-	for msg := range deliveries {
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.MTManager.Name,
-		})
-		var err error
-		var t rec.Record
-		var e EventNotifyRec
-
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.MTManager.Dropped.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "dropped",
-				"rec":   string(msg.Body),
-			}).Error("failed")
-			goto ack
-		}
-		t = e.EventData
-		logCtx = logCtx.WithFields(log.Fields{
-			"e": e.EventName,
-		})
+// mtManagerEvent keeps the reporter events produced while the task was persisted
+type mtManagerEvent struct {
+	rec.Record
+	blacklist blacklistMeta
+	reports   []reporterEvent
+}
+
+type mtManagerHandler struct{}
 
-		if (e.EventName != "Unsubscribe" && e.EventName != " UnsubscribeAll") &&
-			(t.Msisdn == "" || t.ServiceCode == "") {
-			svc.m.MTManager.Dropped.Inc()
-			svc.m.MTManager.Empty.Inc()
+func (mtManagerHandler) Queue() string {
+	return svc.sConfig.Queue.MTManager.Name
+}
+
+func (mtManagerHandler) Metrics() *queueMetrics {
+	return &svc.m.MTManager.queueMetrics
+}
 
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-				"rec":   string(msg.Body),
-			}).Error("failed")
-			goto ack
+func (mtManagerHandler) Decode(body []byte) (*Event, error) {
+	var e EventNotifyRec
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	t := &mtManagerEvent{Record: e.EventData}
+	if e.EventName == "AddBlacklistedNumber" {
+		meta := struct {
+			EventData *blacklistMeta `json:"event_data"`
+		}{&t.blacklist}
+		if err := json.Unmarshal(body, &meta); err != nil {
+			return nil, err
+		}
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: t,
+	}, nil
+}
+
+func (mtManagerHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*mtManagerEvent)
+
+	switch e.Name {
+	case "Unsubscribe",
+		"UnsubscribeAll",
+		"UnsubscribeCampaign",
+		"UnsubscribeService",
+		"StartRetry",
+		"AddBlacklistedNumber",
+		"AddPostPaidNumber",
+		"RemoveBlacklistedNumber",
+		"RemovePostPaidNumber",
+		"TouchRetry",
+		"RemoveRetry",
+		"WriteSubscriptionStatus",
+		"WriteSubscriptionPeriodic",
+		"WriteTransaction":
+	default:
+		return fmt.Errorf("unknown event: %s", e.Name)
+	}
+	switch e.Name {
+	case "UnsubscribeAll", "RemoveBlacklistedNumber", "RemovePostPaidNumber":
+		if t.Msisdn == "" {
+			return errEmptyMessage
 		}
+	case "UnsubscribeCampaign":
 		if t.CampaignId == "" {
-			t.CampaignId = "-"
+			return errEmptyMessage
 		}
+	case "UnsubscribeService":
 		if t.ServiceCode == "" {
-			t.ServiceCode = "-"
+			return errEmptyMessage
 		}
-
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid": t.Tid,
-		})
-		switch e.EventName {
-		case "Unsubscribe":
-			err = unsubscribe(t)
-		case "UnsubscribeAll":
-			err = unsubscribeAll(t)
-		case "StartRetry":
-			err = startRetry(t)
-		case "AddBlacklistedNumber":
-			err = addBlacklistedNumber(t)
-		case "AddPostPaidNumber":
-			err = addPostPaidNumber(t)
-		case "TouchRetry":
-			err = touchRetry(t)
-		case "RemoveRetry":
-			err = removeRetry(t)
-		case "WriteSubscriptionStatus":
-			err = writeSubscriptionStatus(t)
-		case "WriteSubscriptionPeriodic":
-			err = writeSubscriptionPeriodic(t)
-		case "WriteTransaction":
-			err = writeTransaction(t)
-		default:
-			svc.m.MTManager.Dropped.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"event": e.EventName,
-				"msg":   "dropped",
-				"rec":   string(msg.Body),
-			}).Error("unknown event")
-			goto ack
+	default:
+		if e.Name != "Unsubscribe" && (t.Msisdn == "" || t.ServiceCode == "") {
+			return errEmptyMessage
 		}
+	}
+	if t.CampaignId == "" {
+		t.CampaignId = "-"
+	}
+	if t.ServiceCode == "" {
+		t.ServiceCode = "-"
+	}
+	return nil
+}
 
-		if err != nil {
-			svc.m.Common.DBErrors.Inc()
-			svc.m.MTManager.AddToDBErrors.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"event": e.EventName,
-				"error": err.Error(),
-			}).Error("failed")
-			time.Sleep(time.Second)
-			msg.Nack(false, true)
-			continue
-		} else {
-			svc.m.MTManager.AddToDbSuccess.Inc()
-		}
+// Persist runs every task in one transaction: statements of the task
+// are committed together before the message is acked
+func (mtManagerHandler) Persist(e *Event) (err error) {
+	t := e.Data.(*mtManagerEvent)
+
+	exec := func(level sql.IsolationLevel, fn func(db dbExecutor, r rec.Record) error) error {
+		return withTx(level, func(db dbExecutor) error {
+			return fn(db, t.Record)
+		})
+	}
+	report := func(level sql.IsolationLevel, fn func(db dbExecutor, r rec.Record) ([]reporterEvent, error)) ([]reporterEvent, error) {
+		return reportInTx(level, func(db dbExecutor) ([]reporterEvent, error) {
+			return fn(db, t.Record)
+		})
+	}
 
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
+	switch e.Name {
+	case "Unsubscribe":
+		t.reports, err = report(sql.LevelReadCommitted, unsubscribe)
+	case "UnsubscribeAll":
+		// subscriptions are locked with SELECT ... FOR UPDATE
+		t.reports, err = report(sql.LevelReadCommitted, unsubscribeAll)
+	case "UnsubscribeCampaign", "UnsubscribeService":
+		// chunks are committed in their own transactions
+		err = unsubscribeBulk(e.Name, t.Record)
+	case "StartRetry":
+		err = exec(sql.LevelReadCommitted, startRetry)
+	case "AddBlacklistedNumber":
+		t.reports, err = reportInTx(sql.LevelReadCommitted, func(db dbExecutor) ([]reporterEvent, error) {
+			return addBlacklistedNumber(db, t.Record, t.blacklist)
+		})
+	case "AddPostPaidNumber":
+		t.reports, err = report(sql.LevelReadCommitted, addPostPaidNumber)
+	case "RemoveBlacklistedNumber":
+		err = exec(sql.LevelReadCommitted, removeBlacklistedNumber)
+	case "RemovePostPaidNumber":
+		err = exec(sql.LevelReadCommitted, removePostPaidNumber)
+	case "TouchRetry":
+		err = exec(sql.LevelReadCommitted, touchRetry)
+	case "RemoveRetry":
+		// the copy to retries_expired and the delete see the same retry row
+		err = exec(sql.LevelRepeatableRead, removeRetry)
+	case "WriteSubscriptionStatus":
+		t.reports, err = report(sql.LevelReadCommitted, writeSubscriptionStatus)
+	case "WriteSubscriptionPeriodic":
+		err = exec(sql.LevelReadCommitted, writeSubscriptionPeriodic)
+	case "WriteTransaction":
+		// single insert, with the outbox it is written in one transaction
+		t.reports, e.Duplicate, err = writeTransaction(t.Record)
+	}
+	return
+}
 
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
+func (mtManagerHandler) Publish(e *Event) error {
+	t := e.Data.(*mtManagerEvent)
+	for _, r := range t.reports {
+		if err := publishReporter(r.queue, r.collect); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func writeTransaction(r rec.Record) (err error) {
+func writeTransaction(r rec.Record) (reports []reporterEvent, duplicate bool, err error) {
 	begin := time.Now()
 	defer func() {
 		fields := log.Fields{
@@ -135,60 +178,56 @@ func writeTransaction(r rec.Record) (err error) {
 			fields["error"] = err.Error()
 			log.WithFields(fields).Error("write transaction error")
 		} else {
+			fields["duplicate"] = duplicate
 			log.WithFields(fields).Debug("write transaction")
 		}
 
 	}()
-	query := fmt.Sprintf("INSERT INTO %stransactions ("+
-		"tid, "+
-		"sent_at, "+
-		"msisdn, "+
-		"result, "+
-		"operator_code, "+
-		"country_code, "+
-		"id_service, "+
-		"id_subscription, "+
-		"id_campaign, "+
-		"operator_token, "+
-		"price "+
-		") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
-		svc.dbConf.TablePrefix,
-	)
-	if _, err = svc.db.Exec(
-		query,
-		r.Tid,
-		r.SentAt,
-		r.Msisdn,
-		r.Result,
-		r.OperatorCode,
-		r.CountryCode,
-		r.ServiceCode,
-		r.SubscriptionId,
-		r.CampaignId,
-		r.OperatorToken,
-		int(r.Price),
-	); err != nil {
-		err = fmt.Errorf("db.Exec: %s, Query: %s", err.Error(), query)
+	if duplicate, err = svc.sinks.MTManager.write(func(s Sink) (bool, error) {
+		return s.Transaction(r)
+	}); err != nil || duplicate {
 		return
 	}
-
-	publishReporter(svc.sConfig.Queue.Transaction, mid.Collect{
-		Tid:               r.Tid,
-		CampaignUUID:      r.CampaignId,
-		OperatorCode:      r.OperatorCode,
-		Msisdn:            r.Msisdn,
-		Price:             r.Price,
-		TransactionResult: r.Result,
-		AttemptsCount:     r.AttemptsCount,
-	})
+	if !svc.sinks.MTManager.outboxed() {
+		reports = append(reports, transactionReport(r))
+	}
 
 	svc.m.MTManager.WriteTransactionDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
-	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	return
+}
+
+func transactionReport(r rec.Record) reporterEvent {
+	return reporterEvent{
+		queue: svc.sConfig.Queue.Transaction,
+		collect: mid.Collect{
+			Tid:               r.Tid,
+			CampaignUUID:      r.CampaignId,
+			OperatorCode:      r.OperatorCode,
+			Msisdn:            r.Msisdn,
+			Price:             r.Price,
+			TransactionResult: r.Result,
+			AttemptsCount:     r.AttemptsCount,
+		},
+	}
+}
+
+// outflowReport is the reporter outflow of the subscription record
+func outflowReport(r rec.Record) reporterEvent {
+	return reporterEvent{
+		queue: svc.sConfig.Queue.Outflow,
+		collect: mid.Collect{
+			Tid:               r.Tid,
+			CampaignUUID:      r.CampaignId,
+			OperatorCode:      r.OperatorCode,
+			Msisdn:            r.Msisdn,
+			Price:             r.Price,
+			TransactionResult: r.Result,
+			AttemptsCount:     r.AttemptsCount,
+		},
+	}
 }
 
-func unsubscribe(r rec.Record) (err error) {
+func unsubscribe(db dbExecutor, r rec.Record) (reports []reporterEvent, err error) {
 	begin := time.Now()
 	r.SubscriptionStatus = "canceled"
 	defer func() {
@@ -205,6 +244,13 @@ func unsubscribe(r rec.Record) (err error) {
 		}
 		log.WithFields(fields).Debug("unsubscribe")
 	}()
+	history, err := trackSubscriptions(db, "Unsubscribe", r.Tid, []string{"result"},
+		"msisdn = $1 AND id_service = $2 AND result != 'canceled'", r.Msisdn, r.ServiceCode)
+	if err != nil {
+		return
+	}
+
+	cond, condArgs := transitionCond(5, r.SubscriptionStatus)
 	query := fmt.Sprintf("UPDATE %ssubscriptions SET "+
 		"result = $1, "+
 		"attempts_count = attempts_count + 1, "+
@@ -212,47 +258,50 @@ func unsubscribe(r rec.Record) (err error) {
 		"WHERE id = ("+
 		"	SELECT id FROM %ssubscriptions "+
 		"	WHERE msisdn = $3 AND id_service = $4 and result != 'canceled'"+
-		"	ORDER BY id LIMIT 1)",
+		"	ORDER BY id LIMIT 1) AND "+cond,
 		svc.dbConf.TablePrefix,
 		svc.dbConf.TablePrefix,
 	)
 
 	lastPayAttemptAt := r.SentAt
 	var res sql.Result
-	res, err = svc.db.Exec(query,
+	res, err = db.Exec(query, append([]interface{}{
 		r.SubscriptionStatus,
 		lastPayAttemptAt,
 		r.Msisdn,
 		r.ServiceCode,
-	)
+	}, condArgs...)...)
 	if err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		err = newDBError("db.Exec", err, query)
 		return
 	}
 
 	count, err := res.RowsAffected()
 	if err != nil {
-		err = fmt.Errorf("res.RowsAffected: %s", err.Error())
+		err = newDBError("res.RowsAffected", err, "")
+		return
+	}
+	if count == 0 {
+		query = fmt.Sprintf("SELECT id, COALESCE(result, '') FROM %ssubscriptions "+
+			"WHERE msisdn = $1 AND id_service = $2 and result != 'canceled' "+
+			"ORDER BY id LIMIT 1",
+			svc.dbConf.TablePrefix)
+		err = checkTransition(db, "Unsubscribe", r, r.SubscriptionStatus, query, r.Msisdn, r.ServiceCode)
+		return
+	}
+	if err = history.write(db); err != nil {
 		return
 	}
 	if count > 0 {
 		r.Result = r.SubscriptionStatus
-		publishReporter(svc.sConfig.Queue.Outflow, mid.Collect{
-			Tid:               r.Tid,
-			CampaignUUID:      r.CampaignId,
-			OperatorCode:      r.OperatorCode,
-			Msisdn:            r.Msisdn,
-			Price:             r.Price,
-			TransactionResult: r.Result,
-			AttemptsCount:     r.AttemptsCount,
-		})
+		reports = append(reports, outflowReport(r))
 	}
 	svc.m.MTManager.UnsubscribeDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBUpdateDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	return
 }
 
-func unsubscribeAll(r rec.Record) (err error) {
+func unsubscribeAll(db dbExecutor, r rec.Record) (reports []reporterEvent, err error) {
 	begin := time.Now()
 	r.SubscriptionStatus = "purged"
 	if r.OutFlowReason == "" {
@@ -275,55 +324,82 @@ func unsubscribeAll(r rec.Record) (err error) {
 		"id, "+
 		"id_campaign, "+
 		"operator_code, "+
-		"attempts_count "+
+		"attempts_count, "+
+		"COALESCE(result, '') "+
 		"FROM %ssubscriptions "+
 		"WHERE msisdn = $1 AND "+
-		"result NOT IN ('canceled', 'purged', 'rejected', 'blacklisted', 'postpaid')",
+		"result NOT IN ('canceled', 'purged', 'rejected', 'blacklisted', 'postpaid') "+
+		"FOR UPDATE",
 		svc.dbConf.TablePrefix,
 	)
-	rowsUns, err := svc.db.Query(query, r.Msisdn)
+	rowsUns, err := db.Query(query, r.Msisdn)
 	if err != nil {
-		svc.m.Common.DBErrors.Inc()
-		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
-		return err
+		err = newDBError("db.Query", err, query)
+		return
 	}
 	defer rowsUns.Close()
 
 	var unsubscribedRecs []rec.Record
+	var ids []int64
 	for rowsUns.Next() {
 		t := rec.Record{}
-		if err := rowsUns.Scan(
+		if err = rowsUns.Scan(
 			&t.SubscriptionId,
 			&t.CampaignId,
 			&t.OperatorCode,
 			&t.AttemptsCount,
+			&t.Result,
 		); err != nil {
-			err = fmt.Errorf("rows.Scan: %s", err.Error())
-			return err
+			err = newDBError("rows.Scan", err, "")
+			return
 		}
 		unsubscribedRecs = append(unsubscribedRecs, t)
 	}
+	if err = rowsUns.Err(); err != nil {
+		err = newDBError("rows.Err", err, "")
+		return
+	}
+	rowsUns.Close()
+
+	allowed := unsubscribedRecs[:0]
+	for _, t := range unsubscribedRecs {
+		if !transitionAllowed(t.Result, r.SubscriptionStatus) {
+			if err = rejectTransition(db, "UnsubscribeAll", r, t.SubscriptionId, t.Result, r.SubscriptionStatus); err != nil {
+				return
+			}
+			continue
+		}
+		allowed = append(allowed, t)
+		ids = append(ids, t.SubscriptionId)
+	}
+	unsubscribedRecs = allowed
+
+	history, err := trackSubscriptions(db, "UnsubscribeAll", r.Tid, []string{"result", "outflow_reason"},
+		"id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return
+	}
 
+	cond, condArgs := transitionCond(5, r.SubscriptionStatus)
 	query = fmt.Sprintf("UPDATE %ssubscriptions SET "+
 		"result = $1, "+
 		"outflow_reason = $2, "+
 		"last_pay_attempt_at = $3 "+
-		"WHERE msisdn = $4 AND "+
-		"result NOT IN ('canceled', 'purged', 'rejected', 'blacklisted', 'postpaid')",
+		"WHERE id = ANY($4) AND "+cond,
 		svc.dbConf.TablePrefix,
 	)
 
 	lastPayAttemptAt := r.SentAt
 
 	var res sql.Result
-	res, err = svc.db.Exec(query,
+	res, err = db.Exec(query, append([]interface{}{
 		r.SubscriptionStatus,
 		r.OutFlowReason,
 		lastPayAttemptAt,
-		r.Msisdn,
-	)
+		pq.Array(ids),
+	}, condArgs...)...)
 	if err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		err = newDBError("db.Exec", err, query)
 		return
 	}
 
@@ -339,23 +415,22 @@ func unsubscribeAll(r rec.Record) (err error) {
 			log.WithFields(fields).Debug("nothing was purged")
 		}
 	} else {
-		err = fmt.Errorf("res.RowsAffected: %s", err.Error())
+		err = newDBError("res.RowsAffected", err, "")
 		fields["error"] = err.Error()
 		log.WithFields(fields).Debug("cannot get count affected purge request")
 		delete(fields, "error")
 	}
+	if err = history.write(db); err != nil {
+		return
+	}
 
+	// campaign, operator and attempts are of the purged subscription
 	for _, t := range unsubscribedRecs {
-		t.Result = t.SubscriptionStatus
-		publishReporter(svc.sConfig.Queue.Outflow, mid.Collect{
-			Tid:               r.Tid,
-			CampaignUUID:      r.CampaignId,
-			OperatorCode:      r.OperatorCode,
-			Msisdn:            r.Msisdn,
-			Price:             r.Price,
-			TransactionResult: r.Result,
-			AttemptsCount:     r.AttemptsCount,
-		})
+		t.Tid = r.Tid
+		t.Msisdn = r.Msisdn
+		t.Price = r.Price
+		t.Result = r.SubscriptionStatus
+		reports = append(reports, outflowReport(t))
 	}
 	if len(unsubscribedRecs) == 0 {
 		log.WithFields(fields).Debug("nothing to purge")
@@ -363,9 +438,9 @@ func unsubscribeAll(r rec.Record) (err error) {
 
 	svc.m.MTManager.UnsubscribeAllDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBUpdateDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	return
 }
-func writeSubscriptionPeriodic(r rec.Record) (err error) {
+func writeSubscriptionPeriodic(db dbExecutor, r rec.Record) (err error) {
 	begin := time.Now()
 	defer func() {
 		fields := log.Fields{
@@ -380,15 +455,23 @@ func writeSubscriptionPeriodic(r rec.Record) (err error) {
 		}
 		log.WithFields(fields).Debug("write subscription periodic")
 	}()
+	history, err := trackSubscriptions(db, "WriteSubscriptionPeriodic", r.Tid, []string{"periodic"},
+		"id = $1", r.SubscriptionId)
+	if err != nil {
+		return
+	}
 	query := fmt.Sprintf("UPDATE %ssubscriptions SET periodic = $1 WHERE id = $2",
 		svc.dbConf.TablePrefix,
 	)
-	_, err = svc.db.Exec(query,
+	_, err = db.Exec(query,
 		r.Periodic,
 		r.SubscriptionId,
 	)
 	if err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		err = newDBError("db.Exec", err, query)
+		return
+	}
+	if err = history.write(db); err != nil {
 		return
 	}
 	svc.m.MTManager.WriteSubscriptionPeriodicDuration.Observe(time.Since(begin).Seconds())
@@ -396,7 +479,7 @@ func writeSubscriptionPeriodic(r rec.Record) (err error) {
 	return nil
 }
 
-func writeSubscriptionStatus(r rec.Record) (err error) {
+func writeSubscriptionStatus(db dbExecutor, r rec.Record) (reports []reporterEvent, err error) {
 	begin := time.Now()
 	defer func() {
 		fields := log.Fields{
@@ -410,42 +493,56 @@ func writeSubscriptionStatus(r rec.Record) (err error) {
 		}
 		log.WithFields(fields).Debug("write subscription status")
 	}()
+	history, err := trackSubscriptions(db, "WriteSubscriptionStatus", r.Tid, []string{"result"},
+		"id = $1", r.SubscriptionId)
+	if err != nil {
+		return
+	}
+
+	cond, condArgs := transitionCond(4, r.SubscriptionStatus)
 	query := fmt.Sprintf("UPDATE %ssubscriptions SET "+
 		"result = $1, "+
 		"last_pay_attempt_at = $2, "+
 		"attempts_count = attempts_count + 1 "+
-		"where id = $3",
+		"where id = $3 AND "+cond,
 		svc.dbConf.TablePrefix,
 	)
 
 	lastPayAttemptAt := r.SentAt
-	_, err = svc.db.Exec(query,
+	var res sql.Result
+	res, err = db.Exec(query, append([]interface{}{
 		r.SubscriptionStatus,
 		lastPayAttemptAt,
 		r.SubscriptionId,
-	)
+	}, condArgs...)...)
+	if err != nil {
+		err = newDBError("db.Exec", err, query)
+		return
+	}
+	count, err := res.RowsAffected()
 	if err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		err = newDBError("res.RowsAffected", err, "")
+		return
+	}
+	if count == 0 {
+		query = fmt.Sprintf("SELECT id, COALESCE(result, '') FROM %ssubscriptions WHERE id = $1",
+			svc.dbConf.TablePrefix)
+		err = checkTransition(db, "WriteSubscriptionStatus", r, r.SubscriptionStatus, query, r.SubscriptionId)
+		return
+	}
+	if err = history.write(db); err != nil {
 		return
 	}
 	// in case if it was unsub/unreg, it would catch, otherwise not.
 	r.Result = r.SubscriptionStatus
-	publishReporter(svc.sConfig.Queue.Outflow, mid.Collect{
-		Tid:               r.Tid,
-		CampaignUUID:      r.CampaignId,
-		OperatorCode:      r.OperatorCode,
-		Msisdn:            r.Msisdn,
-		Price:             r.Price,
-		TransactionResult: r.Result,
-		AttemptsCount:     r.AttemptsCount,
-	})
+	reports = append(reports, outflowReport(r))
 
 	svc.m.MTManager.WriteSubscriptionStatusDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBUpdateDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	return
 }
 
-func removeRetry(r rec.Record) (err error) {
+func removeRetry(db dbExecutor, r rec.Record) (err error) {
 	begin := time.Now()
 	defer func() {
 		fields := log.Fields{
@@ -499,25 +596,24 @@ func removeRetry(r rec.Record) (err error) {
 			svc.dbConf.TablePrefix,
 			svc.dbConf.TablePrefix,
 		)
-		if _, err = svc.db.Exec(query, r.RetryId); err != nil {
-			err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		if _, err = db.Exec(query, r.RetryId); err != nil {
+			err = newDBError("db.Exec", err, query)
 			return
 		}
 	}
 
 	query = fmt.Sprintf("DELETE FROM %sretries WHERE id = $1", svc.dbConf.TablePrefix)
 
-	if _, err = svc.db.Exec(query, r.RetryId); err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	if _, err = db.Exec(query, r.RetryId); err != nil {
+		err = newDBError("db.Exec", err, query)
 		return
 	}
 	svc.m.MTManager.RemoveRetryDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
 
-func touchRetry(r rec.Record) (err error) {
+func touchRetry(db dbExecutor, r rec.Record) (err error) {
 	begin := time.Now()
 	defer func() {
 		fields := log.Fields{
@@ -539,18 +635,17 @@ func touchRetry(r rec.Record) (err error) {
 		"WHERE id = $2",
 		svc.dbConf.TablePrefix,
 	)
-	if _, err = svc.db.Exec(query, lastPayAttemptAt, r.RetryId); err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	if _, err = db.Exec(query, lastPayAttemptAt, r.RetryId); err != nil {
+		err = newDBError("db.Exec", err, query)
 		return
 	}
 
 	svc.m.MTManager.TouchRetryDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
 
-func startRetry(r rec.Record) (err error) {
+func startRetry(db dbExecutor, r rec.Record) (err error) {
 
 	begin := time.Now()
 	defer func() {
@@ -567,11 +662,11 @@ func startRetry(r rec.Record) (err error) {
 		}
 	}()
 	if r.RetryDays == 0 {
-		err = fmt.Errorf("Retry Keep Days required, service id: %s", r.ServiceCode)
+		err = permanent(fmt.Errorf("Retry Keep Days required, service id: %s", r.ServiceCode))
 		return
 	}
 	if r.DelayHours == 0 {
-		err = fmt.Errorf("Retry Delay Hours required, service id: %s", r.ServiceCode)
+		err = permanent(fmt.Errorf("Retry Delay Hours required, service id: %s", r.ServiceCode))
 		return
 	}
 	query := fmt.Sprintf("INSERT INTO  %sretries ("+
@@ -588,7 +683,7 @@ func startRetry(r rec.Record) (err error) {
 		") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
 		svc.dbConf.TablePrefix,
 	)
-	if _, err = svc.db.Exec(query,
+	if _, err = db.Exec(query,
 		&r.Tid,
 		&r.RetryDays,
 		&r.DelayHours,
@@ -600,68 +695,211 @@ func startRetry(r rec.Record) (err error) {
 		&r.CampaignId,
 		&r.Price,
 	); err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+		err = newDBError("db.Exec", err, query)
 		return
 	}
 
 	svc.m.MTManager.StartRetryDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
 
-func addBlacklistedNumber(r rec.Record) (err error) {
+// addBlacklistedNumber upserts the number, a redelivered or repeated task
+// updates the metadata unless it would shorten the block.
+// Needs an unique key on msisdn_blacklist (msisdn)
+func addBlacklistedNumber(db dbExecutor, r rec.Record, meta blacklistMeta) (reports []reporterEvent, err error) {
 	begin := time.Now()
+	var inserted bool
 	defer func() {
 		fields := log.Fields{
-			"tid":  r.Tid,
-			"took": time.Since(begin),
+			"tid":      r.Tid,
+			"reason":   meta.Reason,
+			"source":   meta.Source,
+			"inserted": inserted,
+			"took":     time.Since(begin),
+		}
+		if meta.ExpiresAt != nil {
+			fields["expires_at"] = meta.ExpiresAt.String()
 		}
 		if err != nil {
+			svc.m.MTManager.AddBlacklistedErrors.Inc()
 			fields["error"] = err.Error()
 			fields["rec"] = fmt.Sprintf("%#v", r)
 		}
 		log.WithFields(fields).Debug("add blacklisted")
 	}()
 
-	query := fmt.Sprintf("INSERT INTO  %smsisdn_blacklist ( msisdn ) VALUES ($1)", svc.dbConf.TablePrefix)
+	// the block is never shortened: a permanent one (NULL expiry) stays permanent,
+	// otherwise the later expiry is kept. The reason and source are replaced
+	// only by the entry that does not shorten the block
+	shorter := "EXCLUDED.expires_at IS NOT NULL AND " +
+		"(b.expires_at IS NULL OR EXCLUDED.expires_at < b.expires_at)"
+	query := fmt.Sprintf("INSERT INTO  %smsisdn_blacklist AS b ( "+
+		"msisdn, "+
+		"reason, "+
+		"source, "+
+		"operator_code, "+
+		"added_at, "+
+		"expires_at "+
+		") VALUES ($1, $2, $3, $4, $5, $6) "+
+		"ON CONFLICT (msisdn) DO UPDATE SET "+
+		"reason = CASE WHEN "+shorter+" THEN b.reason ELSE EXCLUDED.reason END, "+
+		"source = CASE WHEN "+shorter+" THEN b.source ELSE EXCLUDED.source END, "+
+		"operator_code = EXCLUDED.operator_code, "+
+		"expires_at = CASE WHEN b.expires_at IS NULL OR EXCLUDED.expires_at IS NULL THEN NULL "+
+		"ELSE GREATEST(b.expires_at, EXCLUDED.expires_at) END "+
+		"RETURNING (xmax = 0)",
+		svc.dbConf.TablePrefix,
+	)
 
-	if _, err = svc.db.Exec(query, &r.Msisdn); err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	addedAt := r.SentAt
+	if addedAt.IsZero() {
+		addedAt = time.Now()
+	}
+	if err = db.QueryRow(query,
+		&r.Msisdn,
+		meta.Reason,
+		meta.Source,
+		r.OperatorCode,
+		addedAt,
+		meta.ExpiresAt,
+	).Scan(&inserted); err != nil {
+		err = newDBError("db.QueryRow", err, query)
 		return
 	}
 
+	if inserted {
+		svc.m.MTManager.AddBlacklistedSuccess.Inc()
+		reports = blockedReport(r, resultBlacklisted)
+	} else {
+		svc.m.MTManager.AddBlacklistedExisting.Inc()
+	}
 	svc.m.MTManager.AddBlacklistedNumberDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	return
 }
 
-func addPostPaidNumber(r rec.Record) (err error) {
+// addPostPaidNumber skips the number added before.
+// Needs an unique key on msisdn_postpaid (msisdn)
+func addPostPaidNumber(db dbExecutor, r rec.Record) (reports []reporterEvent, err error) {
 	begin := time.Now()
+	var inserted bool
 	defer func() {
 		fields := log.Fields{
-			"tid":  r.Tid,
-			"took": time.Since(begin),
+			"tid":      r.Tid,
+			"inserted": inserted,
+			"took":     time.Since(begin),
 		}
 		if err != nil {
+			svc.m.MTManager.AddPostPaidErrors.Inc()
 			fields["error"] = err.Error()
 			fields["rec"] = fmt.Sprintf("%#v", r)
 		}
-		err = nil
 		log.WithFields(fields).Debug("add postpaid")
 	}()
 
-	query := fmt.Sprintf("INSERT INTO %smsisdn_postpaid ( msisdn ) VALUES ($1)",
+	query := fmt.Sprintf("INSERT INTO %smsisdn_postpaid ( msisdn ) VALUES ($1) "+
+		"ON CONFLICT (msisdn) DO NOTHING",
 		svc.dbConf.TablePrefix,
 	)
-	if _, err = svc.db.Exec(query, &r.Msisdn); err != nil {
-		err = fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	var res sql.Result
+	if res, err = db.Exec(query, &r.Msisdn); err != nil {
+		err = newDBError("db.Exec", err, query)
+		return
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		err = newDBError("res.RowsAffected", err, "")
 		return
 	}
 
+	if inserted = count > 0; inserted {
+		svc.m.MTManager.AddPostPaidSuccess.Inc()
+		reports = blockedReport(r, resultPostPaid)
+	} else {
+		svc.m.MTManager.AddPostPaidExisting.Inc()
+	}
 	svc.m.MTManager.AddPostPaidNumberDuration.Observe(time.Since(begin).Seconds())
-	svc.m.MTManager.AddToDBDuration.Observe(time.Since(begin).Seconds())
 	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return
+}
+
+// blockedReport tells the dispatchers about the newly blocked number,
+// the result is blacklisted or postpaid
+func blockedReport(r rec.Record, result string) []reporterEvent {
+	if svc.sConfig.Queue.Blocked == "" {
+		return nil
+	}
+	return []reporterEvent{{
+		queue: svc.sConfig.Queue.Blocked,
+		collect: mid.Collect{
+			Tid:               r.Tid,
+			CampaignUUID:      r.CampaignId,
+			OperatorCode:      r.OperatorCode,
+			Msisdn:            r.Msisdn,
+			TransactionResult: result,
+		},
+	}}
+}
+
+func removeBlacklistedNumber(db dbExecutor, r rec.Record) (err error) {
+	begin := time.Now()
+	var count int64
+	defer func() {
+		fields := log.Fields{
+			"tid":     r.Tid,
+			"removed": count,
+			"took":    time.Since(begin),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			fields["rec"] = fmt.Sprintf("%#v", r)
+		}
+		log.WithFields(fields).Debug("remove blacklisted")
+	}()
+
+	query := fmt.Sprintf("DELETE FROM %smsisdn_blacklist WHERE msisdn = $1", svc.dbConf.TablePrefix)
+	var res sql.Result
+	if res, err = db.Exec(query, r.Msisdn); err != nil {
+		err = newDBError("db.Exec", err, query)
+		return
+	}
+	if count, err = res.RowsAffected(); err != nil {
+		err = newDBError("res.RowsAffected", err, "")
+		return
+	}
+
+	svc.m.MTManager.RemoveBlacklistedNumberDuration.Observe(time.Since(begin).Seconds())
+	return nil
+}
+
+func removePostPaidNumber(db dbExecutor, r rec.Record) (err error) {
+	begin := time.Now()
+	var count int64
+	defer func() {
+		fields := log.Fields{
+			"tid":     r.Tid,
+			"removed": count,
+			"took":    time.Since(begin),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			fields["rec"] = fmt.Sprintf("%#v", r)
+		}
+		log.WithFields(fields).Debug("remove postpaid")
+	}()
+
+	query := fmt.Sprintf("DELETE FROM %smsisdn_postpaid WHERE msisdn = $1", svc.dbConf.TablePrefix)
+	var res sql.Result
+	if res, err = db.Exec(query, r.Msisdn); err != nil {
+		err = newDBError("db.Exec", err, query)
+		return
+	}
+	if count, err = res.RowsAffected(); err != nil {
+		err = newDBError("res.RowsAffected", err, "")
+		return
+	}
+
+	svc.m.MTManager.RemovePostPaidNumberDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
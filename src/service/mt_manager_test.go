@@ -0,0 +1,296 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	rec "github.com/linkit360/go-utils/rec"
+)
+
+// fakeDB is a database/sql driver answering the statements with the handle func
+// of the test. Transactions are accepted and only counted
+type fakeDB struct {
+	handle func(query string, args []driver.Value) (fakeResult, error)
+
+	mu      sync.Mutex
+	queries []fakeQuery
+	commits int
+}
+
+type fakeQuery struct {
+	query string
+	args  []driver.Value
+}
+
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+func newFakeDB(handle func(query string, args []driver.Value) (fakeResult, error)) (*fakeDB, *sql.DB) {
+	f := &fakeDB{handle: handle}
+	return f, sql.OpenDB(f)
+}
+
+// executed returns the statements starting with the prefix
+func (f *fakeDB) executed(prefix string) []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var res []fakeQuery
+	for _, q := range f.queries {
+		if strings.HasPrefix(q.query, prefix) {
+			res = append(res, q)
+		}
+	}
+	return res
+}
+
+// committed returns how many transactions are committed
+func (f *fakeDB) committed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits
+}
+
+func (f *fakeDB) run(query string, args []driver.Value) (fakeResult, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, fakeQuery{query: query, args: args})
+	f.mu.Unlock()
+	return f.handle(query, args)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{f}
+}
+
+type fakeDriver struct {
+	db *fakeDB
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return fakeConn{d.db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{c.db}, nil
+}
+
+func (c fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{c.db}, nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{res: res}, nil
+}
+
+type fakeRows struct {
+	res  fakeResult
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.res.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.res.rows) {
+		return io.EOF
+	}
+	copy(dest, r.res.rows[r.next])
+	r.next++
+	return nil
+}
+
+// useTestDB points the service to the fake db with the outbox
+// and the history disabled
+func useTestDB(t *testing.T, db *sql.DB) {
+	initTestMetrics()
+	saved := svc
+	t.Cleanup(func() {
+		svc = saved
+	})
+	svc.db = db
+	svc.outbox = newOutbox(OutboxConfig{})
+	svc.sConfig.History.Enabled = false
+	svc.sConfig.Transitions.Audit = false
+	svc.sConfig.Queue.Outflow = "reporter_outflow"
+}
+
+func TestUnsubscribeAllReportsEveryPurgedSubscription(t *testing.T) {
+	columns := []string{"id", "id_campaign", "operator_code", "attempts_count", "result"}
+	subscriptions := [][]driver.Value{
+		{int64(11), "campaign-a", int64(41001), int64(3), resultPaid},
+		{int64(12), "campaign-b", int64(41002), int64(0), ""},
+		{int64(13), "campaign-c", int64(25002), int64(7), resultFailed},
+		// a blacklisted subscription is not purged
+		{int64(14), "campaign-d", int64(41001), int64(1), resultBlacklisted},
+	}
+	fake, db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT id, id_campaign"):
+			return fakeResult{columns: columns, rows: subscriptions}, nil
+		case strings.HasPrefix(query, "UPDATE subscriptions"):
+			return fakeResult{affected: 3}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	})
+	defer db.Close()
+	useTestDB(t, db)
+
+	e := &Event{
+		Name: "UnsubscribeAll",
+		Tid:  "tid-purge",
+		Data: &mtManagerEvent{Record: rec.Record{
+			Tid:          "tid-purge",
+			Msisdn:       "79001234567",
+			CampaignId:   "campaign-of-the-request",
+			OperatorCode: 1,
+			Price:        15,
+		}},
+	}
+	h := mtManagerHandler{}
+	if err := h.Validate(e, log.WithField("test", t.Name())); err != nil {
+		t.Fatalf("Validate: %s", err.Error())
+	}
+	if err := h.Persist(e); err != nil {
+		t.Fatalf("Persist: %s", err.Error())
+	}
+
+	updates := fake.executed("UPDATE subscriptions")
+	if len(updates) != 1 {
+		t.Fatalf("updates = %d, want 1", len(updates))
+	}
+	if ids := updates[0].args[3]; ids != "{11,12,13}" {
+		t.Errorf("updated ids = %v, want {11,12,13}", ids)
+	}
+
+	want := []struct {
+		campaign string
+		operator int64
+		attempts int
+	}{
+		{"campaign-a", 41001, 3},
+		{"campaign-b", 41002, 0},
+		{"campaign-c", 25002, 7},
+	}
+	reports := e.Data.(*mtManagerEvent).reports
+	if len(reports) != len(want) {
+		t.Fatalf("reports = %d, want one per purged subscription: %d", len(reports), len(want))
+	}
+	for i, w := range want {
+		r := reports[i]
+		if r.queue != "reporter_outflow" {
+			t.Errorf("report %d queue = %s", i, r.queue)
+		}
+		c := r.collect
+		if c.CampaignUUID != w.campaign || c.OperatorCode != w.operator || c.AttemptsCount != w.attempts {
+			t.Errorf("report %d = campaign %s operator %d attempts %d, want %s %d %d",
+				i, c.CampaignUUID, c.OperatorCode, c.AttemptsCount, w.campaign, w.operator, w.attempts)
+		}
+		if c.Tid != "tid-purge" || c.Msisdn != "79001234567" || c.Price != 15 || c.TransactionResult != resultPurged {
+			t.Errorf("report %d = %#v", i, c)
+		}
+	}
+}
+
+func TestValidateUnsubscribeAllRequiresMsisdn(t *testing.T) {
+	initTestMetrics()
+	e := &Event{
+		Name: "UnsubscribeAll",
+		Tid:  "tid-purge",
+		Data: &mtManagerEvent{Record: rec.Record{Tid: "tid-purge"}},
+	}
+	if err := (mtManagerHandler{}).Validate(e, log.WithField("test", t.Name())); err != errEmptyMessage {
+		t.Fatalf("Validate = %v, want %v", err, errEmptyMessage)
+	}
+}
+
+func TestStartRetryWithoutDaysIsPermanent(t *testing.T) {
+	_, db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	})
+	defer db.Close()
+	useTestDB(t, db)
+
+	for _, r := range []rec.Record{
+		{Tid: "tid-retry", ServiceCode: "777", DelayHours: 8},
+		{Tid: "tid-retry", ServiceCode: "777", RetryDays: 10},
+	} {
+		err := startRetry(db, r)
+		if err == nil {
+			t.Fatalf("startRetry(%#v): no error", r)
+		}
+		if class := classifyDBError(err); class != errPermanent {
+			t.Errorf("startRetry error %q is %s, want it dead lettered", err.Error(), class)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutboxConfig enables writing reporter events to the outbox table in the
+// transaction of the event row, the relay publishes them afterwards
+type OutboxConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	BatchSize int  `yaml:"batch_size" default:"100"`
+	PollMs    int  `yaml:"poll_ms" default:"1000"`
+	// KeepHours is how long sent rows are kept
+	KeepHours int `yaml:"keep_hours" default:"24"`
+}
+
+type outbox struct {
+	conf OutboxConfig
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newOutbox(conf OutboxConfig) *outbox {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	if conf.PollMs <= 0 {
+		conf.PollMs = 1000
+	}
+	o := &outbox{
+		conf: conf,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if conf.Enabled {
+		go o.relay()
+	} else {
+		close(o.done)
+	}
+	return o
+}
+
+func (o *outbox) enabled() bool {
+	return o.conf.Enabled
+}
+
+// add writes reporter events, it does nothing when the outbox is disabled
+func (o *outbox) add(db dbExecutor, reports []reporterEvent) error {
+	if !o.conf.Enabled {
+		return nil
+	}
+	query := fmt.Sprintf("INSERT INTO %sreporter_outbox (queue, body) VALUES ($1, $2)",
+		svc.dbConf.TablePrefix)
+	for _, r := range reports {
+		body, err := reporterBody(r.collect)
+		if err != nil {
+			return fmt.Errorf("reporterBody: %s", err.Error())
+		}
+		if _, err := db.Exec(query, r.queue, string(body)); err != nil {
+			return newDBError("db.Exec", err, query)
+		}
+	}
+	return nil
+}
+
+// relay publishes pending rows and marks the confirmed ones sent. A row
+// is published again if the process dies before the mark is committed
+func (o *outbox) relay() {
+	defer close(o.done)
+	ticker := time.NewTicker(time.Duration(o.conf.PollMs) * time.Millisecond)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-cleanup.C:
+			o.cleanup()
+		case <-ticker.C:
+			// relay until the pending rows are less than a batch
+			for {
+				count, err := o.relayBatch()
+				if err != nil {
+					svc.m.Common.DBErrors.Inc(classifyDBError(err))
+					log.WithField("error", err.Error()).Error("outbox relay")
+					break
+				}
+				if count < o.conf.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (o *outbox) relayBatch() (count int, err error) {
+	begin := time.Now()
+	tx, err := svc.db.Begin()
+	if err != nil {
+		return 0, newDBError("db.Begin", err, "")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// skip locked lets several qlistener instances relay at once
+	query := fmt.Sprintf("SELECT id, queue, body FROM %sreporter_outbox "+
+		"WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+		svc.dbConf.TablePrefix)
+	rows, err := tx.Query(query, o.conf.BatchSize)
+	if err != nil {
+		return 0, newDBError("tx.Query", err, query)
+	}
+	var ids []int64
+	var queues []string
+	var bodies [][]byte
+	for rows.Next() {
+		var id int64
+		var queue, body string
+		if err = rows.Scan(&id, &queue, &body); err != nil {
+			rows.Close()
+			return 0, newDBError("rows.Scan", err, "")
+		}
+		ids = append(ids, id)
+		queues = append(queues, queue)
+		bodies = append(bodies, []byte(body))
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, newDBError("rows.Err", err, "")
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, tx.Commit()
+	}
+
+	// the batch is published at once and then the confirms are waited for,
+	// so the rows are locked for one confirm round trip. Failed rows are
+	// relayed on the next poll
+	var published []int64
+	for i, err := range svc.publisher.publishAll(queues, bodies) {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"q":     queues[i],
+				"error": err.Error(),
+			}).Error("outbox publish")
+			continue
+		}
+		published = append(published, ids[i])
+	}
+	if len(published) == 0 {
+		return 0, tx.Commit()
+	}
+
+	query = fmt.Sprintf("UPDATE %sreporter_outbox SET sent_at = NOW() WHERE id = ANY($1)",
+		svc.dbConf.TablePrefix)
+	if _, err = tx.Exec(query, pq.Array(published)); err != nil {
+		return 0, newDBError("tx.Exec", err, query)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, newDBError("tx.Commit", err, "")
+	}
+	log.WithFields(log.Fields{
+		"count": len(published),
+		"took":  time.Since(begin).String(),
+	}).Debug("outbox relayed")
+	return len(published), nil
+}
+
+func (o *outbox) cleanup() {
+	query := fmt.Sprintf("DELETE FROM %sreporter_outbox "+
+		"WHERE sent_at < (CURRENT_TIMESTAMP - %d * INTERVAL '1 hour')",
+		svc.dbConf.TablePrefix,
+		o.conf.KeepHours,
+	)
+	if _, err := svc.db.Exec(query); err != nil {
+		svc.m.Common.DBErrors.Inc(classifyDBError(err))
+		log.WithFields(log.Fields{
+			"query": query,
+			"error": err.Error(),
+		}).Error("outbox cleanup")
+	}
+}
+
+// stop waits for the relay to finish the current batch
+func (o *outbox) stop() {
+	o.once.Do(func() {
+		close(o.quit)
+	})
+	<-o.done
+}
@@ -1,12 +1,12 @@
 package service
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	mid "github.com/linkit360/go-mid/service"
 	"github.com/linkit360/go-pixel/src/notifier"
@@ -17,219 +17,171 @@ type EventNotifyPixel struct {
 	EventData notifier.Pixel `json:"event_data,omitempty"`
 }
 
-func processPixels(deliveries <-chan amqp.Delivery) {
-	for msg := range deliveries {
-		var t notifier.Pixel
-		var begin time.Time
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.PixelSent.Name,
-		})
-		var e EventNotifyPixel
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.Pixels.Dropped.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("failed")
+type pixelsHandler struct{}
 
-			goto ack
-		}
-		t = e.EventData
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid":   t.Tid,
-			"event": e.EventName,
-		})
-		if t.CampaignCode == "" {
-			t.CampaignCode = "0"
-		}
-		if t.ServiceCode == "" {
-			t.ServiceCode = "0"
+func (pixelsHandler) Queue() string {
+	return svc.sConfig.Queue.PixelSent.Name
+}
+
+func (pixelsHandler) Metrics() *queueMetrics {
+	return &svc.m.Pixels.queueMetrics
+}
+
+func (pixelsHandler) Decode(body []byte) (*Event, error) {
+	var e EventNotifyPixel
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: &e.EventData,
+	}, nil
+}
+
+func (pixelsHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*notifier.Pixel)
+
+	switch e.Name {
+	case "transaction", "update", "buffer", "remove_buffered":
+	default:
+		return fmt.Errorf("unknown event: %s", e.Name)
+	}
+	if t.CampaignCode == "" {
+		t.CampaignCode = "0"
+	}
+	if t.ServiceCode == "" {
+		t.ServiceCode = "0"
+	}
+	return nil
+}
+
+// Inserts reports the pixel transactions only, the subscription updates
+// and the buffer are counted in their own metrics
+func (pixelsHandler) Inserts(e *Event) bool {
+	return e.Name == "transaction"
+}
+
+func (pixelsHandler) Persist(e *Event) error {
+	t := e.Data.(*notifier.Pixel)
+
+	switch e.Name {
+	case "transaction":
+		var err error
+		if e.Duplicate, err = svc.sinks.Pixels.write(func(s Sink) (bool, error) {
+			return s.PixelTransaction(t)
+		}); err != nil {
+			return err
 		}
-		begin = time.Now()
-		switch e.EventName {
-		case "transaction":
-			query := fmt.Sprintf("INSERT INTO %spixel_transactions ( "+
-				"sent_at, "+
-				"tid, "+
-				"msisdn, "+
-				"pixel, "+
-				"endpoint, "+
-				"id_campaign, "+
-				"operator_code, "+
-				"country_code, "+
-				"publisher, "+
-				"response_code "+
-				") VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
-				svc.dbConf.TablePrefix)
-
-			begin := time.Now()
-			if _, err := svc.db.Exec(query,
-				t.SentAt,
-				t.Tid,
-				t.Msisdn,
-				t.Pixel,
-				t.Endpoint,
-				t.CampaignCode,
-				t.OperatorCode,
-				t.CountryCode,
-				t.Publisher,
-				t.ResponseCode,
-			); err != nil {
-				svc.m.Common.DBErrors.Inc()
-				svc.m.Pixels.AddToDBErrors.Inc()
-
-				logCtx.WithFields(log.Fields{
-					"query": query,
-					"error": err.Error(),
-					"msg":   "dropped",
-				}).Error("failed")
-				time.Sleep(time.Second)
-				msg.Nack(false, true)
-				continue
-			} else {
-				svc.m.Pixels.AddToDbSuccess.Inc()
-				svc.m.Pixels.AddToDBDuration.Observe(time.Since(begin).Seconds())
-				logCtx.WithFields(log.Fields{
-					"took": time.Since(begin),
-				}).Info("success")
-
-				publishReporter(svc.sConfig.Queue.Pixel, mid.Collect{
-					Tid:          t.Tid,
-					CampaignUUID: t.CampaignCode,
-					OperatorCode: t.OperatorCode,
-				})
-			}
 
-		case "update":
-			query := fmt.Sprintf("UPDATE %ssubscriptions SET "+
-				" pixel = $1,  "+
-				" publisher = $2,  "+
-				" pixel_sent = $3,  "+
-				" pixel_sent_at = $4  "+
-				" WHERE id = $5 ",
-				svc.dbConf.TablePrefix)
-
-			begin := time.Now()
-			if _, err := svc.db.Exec(query,
+	case "update":
+		query := fmt.Sprintf("UPDATE %ssubscriptions SET "+
+			" pixel = $1,  "+
+			" publisher = $2,  "+
+			" pixel_sent = $3,  "+
+			" pixel_sent_at = $4  "+
+			" WHERE id = $5 ",
+			svc.dbConf.TablePrefix)
+
+		begin := time.Now()
+		if err := withTx(sql.LevelReadCommitted, func(db dbExecutor) error {
+			history, err := trackSubscriptions(db, "update", t.Tid,
+				[]string{"pixel", "publisher", "pixel_sent"}, "id = $1", t.SubscriptionId)
+			if err != nil {
+				return err
+			}
+			if _, err := db.Exec(query,
 				t.Pixel,
 				t.Publisher,
 				t.Sent,
 				time.Now(),
 				t.SubscriptionId,
 			); err != nil {
-				svc.m.Common.DBErrors.Inc()
-				svc.m.Pixels.UpdateSubscriptionToDBErrors.Inc()
-
-				logCtx.WithFields(log.Fields{
-					"query": query,
-					"error": err.Error(),
-				}).Error("requeue")
-				time.Sleep(time.Second)
-				msg.Nack(false, true)
-				continue
-			} else {
-				svc.m.Pixels.UpdateDBDuration.Observe(time.Since(begin).Seconds())
-				logCtx.WithFields(log.Fields{
-					"took": time.Since(begin),
-				}).Info("success")
+				return newDBError("db.Exec", err, query)
 			}
-		case "buffer":
-			query := fmt.Sprintf("INSERT INTO %spixel_buffer ( "+
-				"sent_at, "+
-				"id_service, "+
-				"id_campaign, "+
-				"tid, "+
-				"pixel "+
-				") VALUES ( $1, $2, $3, $4, $5)",
-				svc.dbConf.TablePrefix,
-			)
-
-			begin := time.Now()
-			if _, err := svc.db.Exec(query,
-				t.SentAt,
-				t.ServiceCode,
-				t.CampaignCode,
-				t.Tid,
-				t.Pixel,
-			); err != nil {
-
-				svc.m.Common.DBErrors.Inc()
-				svc.m.Pixels.BufferAddToDBErrors.Inc()
-
-				logCtx.WithFields(log.Fields{
-					"query": query,
-					"error": err.Error(),
-				}).Error("dropped")
-
-				goto ack
-			} else {
-				svc.m.Pixels.BufferAddToDBDuration.Observe(time.Since(begin).Seconds())
-				svc.m.Pixels.BufferAddToDbSuccess.Inc()
-				logCtx.WithFields(log.Fields{
-					"took": time.Since(begin),
-				}).Info("success")
-			}
-
-			begin = time.Now().UTC()
-			query = fmt.Sprintf("DELETE FROM "+
-				"%spixel_buffer WHERE sent_at < "+
-				"(CURRENT_TIMESTAMP - %d * INTERVAL '1 hour' )",
-				svc.dbConf.TablePrefix,
-				svc.sConfig.PixelBufferTimoutHours,
-			)
-			if _, err := svc.db.Exec(query); err != nil {
-				svc.m.Common.DBErrors.Inc()
-				logCtx.WithFields(log.Fields{
-					"query": query,
-					"error": err.Error(),
-				}).Error("haven't cleaned pixel")
-
-			} else {
-				logCtx.WithFields(log.Fields{
-					"took": time.Since(begin),
-				}).Info("cleaned pixel buffers")
-			}
-		case "remove_buffered":
-			query := fmt.Sprintf("delete from %spixel_buffer WHERE id_campaign = $1 AND pixel = $2 ",
-				svc.dbConf.TablePrefix)
-
-			begin := time.Now()
-			if _, err := svc.db.Exec(query, t.CampaignCode, t.Pixel); err != nil {
-				svc.m.Common.DBErrors.Inc()
-
-				logCtx.WithFields(log.Fields{
-					"query": query,
-					"error": err.Error(),
-				}).Error("requeue")
-				time.Sleep(time.Second)
-				msg.Nack(false, true)
-				continue
-			} else {
-				logCtx.WithFields(log.Fields{
-					"took": time.Since(begin),
-				}).Info("success")
-			}
-		default:
-			svc.m.Pixels.Dropped.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"event": e.EventName,
-				"msg":   "dropped",
-			}).Error("unknown event")
-			goto ack
+			return history.write(db)
+		}); err != nil {
+			svc.m.Pixels.UpdateSubscriptionToDBErrors.Inc()
+			return err
+		}
+		svc.m.Pixels.UpdateSubscriptionSuccess.Inc()
+		svc.m.Pixels.UpdateDBDuration.Observe(time.Since(begin).Seconds())
+		svc.m.Common.DBUpdateDuration.Observe(time.Since(begin).Seconds())
+
+	case "buffer":
+		query := fmt.Sprintf("INSERT INTO %spixel_buffer ( "+
+			"sent_at, "+
+			"id_service, "+
+			"id_campaign, "+
+			"tid, "+
+			"pixel "+
+			") VALUES ( $1, $2, $3, $4, $5)",
+			svc.dbConf.TablePrefix,
+		)
+
+		begin := time.Now()
+		if _, err := svc.db.Exec(query,
+			t.SentAt,
+			t.ServiceCode,
+			t.CampaignCode,
+			t.Tid,
+			t.Pixel,
+		); err != nil {
+			svc.m.Pixels.BufferAddToDBErrors.Inc()
+			return drop(newDBError("db.Exec", err, query))
 		}
-		svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
+		svc.m.Pixels.BufferAddToDBDuration.Observe(time.Since(begin).Seconds())
+		svc.m.Pixels.BufferAddToDbSuccess.Inc()
 
-			logCtx.WithFields(log.Fields{
+		begin = time.Now()
+		query = fmt.Sprintf("DELETE FROM "+
+			"%spixel_buffer WHERE sent_at < "+
+			"(CURRENT_TIMESTAMP - %d * INTERVAL '1 hour' )",
+			svc.dbConf.TablePrefix,
+			svc.sConfig.PixelBufferTimoutHours,
+		)
+		if _, err := svc.db.Exec(query); err != nil {
+			svc.m.Common.DBErrors.Inc(classifyDBError(err))
+			log.WithFields(log.Fields{
+				"tid":   t.Tid,
+				"query": query,
 				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
+			}).Error("haven't cleaned pixel")
+		} else {
+			log.WithFields(log.Fields{
+				"tid":  t.Tid,
+				"took": time.Since(begin),
+			}).Info("cleaned pixel buffers")
 		}
+
+	case "remove_buffered":
+		query := fmt.Sprintf("delete from %spixel_buffer WHERE id_campaign = $1 AND pixel = $2 ",
+			svc.dbConf.TablePrefix)
+
+		if _, err := svc.db.Exec(query, t.CampaignCode, t.Pixel); err != nil {
+			svc.m.Pixels.RemoveBufferedErrors.Inc()
+			return newDBError("db.Exec", err, query)
+		}
+		svc.m.Pixels.RemoveBufferedSuccess.Inc()
+	}
+	return nil
+}
+
+func (pixelsHandler) Publish(e *Event) error {
+	if e.Name != "transaction" || svc.sinks.Pixels.outboxed() {
+		return nil
+	}
+	r := pixelReport(e.Data.(*notifier.Pixel))
+	return publishReporter(r.queue, r.collect)
+}
+
+func pixelReport(t *notifier.Pixel) reporterEvent {
+	return reporterEvent{
+		queue: svc.sConfig.Queue.Pixel,
+		collect: mid.Collect{
+			Tid:          t.Tid,
+			CampaignUUID: t.CampaignCode,
+			OperatorCode: t.OperatorCode,
+		},
 	}
 }
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	amqp_client "github.com/linkit360/go-utils/amqp"
+)
+
+// PublisherConfig configures publishing to the reporter and dead letter queues
+type PublisherConfig struct {
+	// ConfirmTimeoutMs is how long the broker confirm is waited for
+	ConfirmTimeoutMs int `yaml:"confirm_timeout_ms" default:"5000"`
+}
+
+var (
+	errPublishNacked  = errors.New("publish is nacked by the broker")
+	errPublishTimeout = errors.New("publish confirm timeout")
+	errPublishClosed  = errors.New("channel closed before confirm")
+	errPublisherDown  = errors.New("publisher is closed")
+)
+
+// publisher publishes in confirm mode and waits for the broker ack,
+// so the caller knows the message is stored. amqp.Notifier of go-utils
+// publishes from its own buffer and never reports the result
+type publisher struct {
+	url     string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	session *publishSession
+	// dialing is the dial in progress, publishes and checks wait for the same one
+	dialing *dialing
+}
+
+// publishSession is one connection in confirm mode. Delivery tags start
+// from 1 on every channel, confirms are matched to waiters by the tag
+type publishSession struct {
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	tag      uint64
+	waiters  map[uint64]chan bool
+	declared map[string]bool
+}
+
+func newPublisher(connConf amqp_client.ConnectionConfig, conf PublisherConfig) *publisher {
+	timeout := time.Duration(conf.ConfirmTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &publisher{
+		url: fmt.Sprintf("amqp://%s:%s@%s:%s/",
+			connConf.User, connConf.Pass, connConf.Host, connConf.Port),
+		timeout: timeout,
+	}
+}
+
+// connect returns the session, the broker is dialed if there is none.
+// The dial runs without p.mu, so a hanging broker does not block the confirms
+// and the check. The caller gives up on the context while the dial goes on,
+// the next callers wait for the same dial
+func (p *publisher) connect(ctx context.Context) (*publishSession, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPublisherDown
+	}
+	if p.session != nil {
+		s := p.session
+		p.mu.Unlock()
+		return s, nil
+	}
+	d := p.dialing
+	if d == nil {
+		d = &dialing{done: make(chan struct{})}
+		p.dialing = d
+		go p.dial(d)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.session, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dialing is the dial in progress, session and err are set before done is closed
+type dialing struct {
+	done    chan struct{}
+	session *publishSession
+	err     error
+}
+
+// dial opens the session for connect, the publisher closed meanwhile closes it
+func (p *publisher) dial(d *dialing) {
+	s, err := p.open()
+
+	p.mu.Lock()
+	p.dialing = nil
+	keep := err == nil && !p.closed
+	if keep {
+		p.start(s)
+	} else if err == nil {
+		err = errPublisherDown
+	}
+	d.session, d.err = p.session, err
+	close(d.done)
+	p.mu.Unlock()
+
+	if s != nil && !keep {
+		s.conn.Close()
+	}
+}
+
+// open opens the connection in confirm mode, it does not need p.mu
+func (p *publisher) open() (*publishSession, error) {
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, fmt.Errorf("amqp.Dial: %s", err.Error())
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("conn.Channel: %s", err.Error())
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ch.Confirm: %s", err.Error())
+	}
+	return &publishSession{
+		conn:     conn,
+		ch:       ch,
+		waiters:  make(map[uint64]chan bool),
+		declared: make(map[string]bool),
+	}, nil
+}
+
+// start makes the dialed session current, called under p.mu
+func (p *publisher) start(s *publishSession) {
+	go p.confirms(s, s.ch.NotifyPublish(make(chan amqp.Confirmation, 1000)))
+	p.session = s
+	log.Info("publisher connected")
+}
+
+// confirms passes broker acks to the waiters. The channel is closed
+// by the driver on connection loss, pending publishes are failed then
+func (p *publisher) confirms(s *publishSession, confirms <-chan amqp.Confirmation) {
+	for c := range confirms {
+		p.mu.Lock()
+		if w, ok := s.waiters[c.DeliveryTag]; ok {
+			w <- c.Ack
+			delete(s.waiters, c.DeliveryTag)
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for tag, w := range s.waiters {
+		close(w)
+		delete(s.waiters, tag)
+	}
+	if p.session == s {
+		p.session = nil
+		log.Error("publisher disconnected")
+	}
+}
+
+// drop forgets the broken session, called under p.mu. The connection
+// is closed after p.mu is released: closing waits for the confirms
+// goroutine, which takes p.mu
+func (p *publisher) drop(s *publishSession) {
+	if p.session == s {
+		p.session = nil
+	}
+}
+
+// publish sends the body to the queue and waits for the broker confirm
+func (p *publisher) publish(queue string, body []byte) error {
+	return p.publishMsg(queue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+}
+
+// publishMsg is publish of the message with properties and headers
+func (p *publisher) publishMsg(queue string, msg amqp.Publishing) error {
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	c, err := p.send(ctx, queue, msg)
+	if err == nil {
+		err = p.confirm(ctx, c)
+	}
+	svc.m.Publish.observe(queue, begin, err)
+	return err
+}
+
+// publishAll publishes the bodies to their queues at once and then waits
+// for the confirms, it returns the error of every message
+func (p *publisher) publishAll(queues []string, bodies [][]byte) []error {
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	errs := make([]error, len(bodies))
+	confirms := make([]pendingConfirm, len(bodies))
+	for i, body := range bodies {
+		confirms[i], errs[i] = p.send(ctx, queues[i], amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	}
+	for i := range bodies {
+		if errs[i] == nil {
+			errs[i] = p.confirm(ctx, confirms[i])
+		}
+		svc.m.Publish.observe(queues[i], begin, errs[i])
+	}
+	return errs
+}
+
+// pendingConfirm is the published message waiting for the broker ack
+type pendingConfirm struct {
+	s   *publishSession
+	tag uint64
+	w   chan bool
+}
+
+// send publishes the message, the context bounds the wait for the connection
+func (p *publisher) send(ctx context.Context, queue string, msg amqp.Publishing) (pendingConfirm, error) {
+	s, err := p.connect(ctx)
+	if err != nil {
+		return pendingConfirm{}, err
+	}
+
+	p.mu.Lock()
+	if p.session != s {
+		// dropped by a failed publish meanwhile
+		p.mu.Unlock()
+		return pendingConfirm{}, errPublishClosed
+	}
+	if !s.declared[queue] {
+		if _, err := s.ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+			p.drop(s)
+			p.mu.Unlock()
+			s.conn.Close()
+			return pendingConfirm{}, fmt.Errorf("ch.QueueDeclare: %s", err.Error())
+		}
+		s.declared[queue] = true
+	}
+	if err := s.ch.Publish("", queue, false, false, msg); err != nil {
+		p.drop(s)
+		p.mu.Unlock()
+		s.conn.Close()
+		return pendingConfirm{}, fmt.Errorf("ch.Publish: %s", err.Error())
+	}
+	s.tag++
+	c := pendingConfirm{s: s, tag: s.tag, w: make(chan bool, 1)}
+	s.waiters[c.tag] = c.w
+	p.mu.Unlock()
+	return c, nil
+}
+
+// confirm waits for the broker ack of the sent message until the context is done
+func (p *publisher) confirm(ctx context.Context, c pendingConfirm) error {
+	select {
+	case ack, ok := <-c.w:
+		if !ok {
+			return errPublishClosed
+		}
+		if !ack {
+			return errPublishNacked
+		}
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(c.s.waiters, c.tag)
+		p.mu.Unlock()
+		return errPublishTimeout
+	}
+}
+
+// check connects if needed, it is used by the readiness probe
+func (p *publisher) check(ctx context.Context) error {
+	_, err := p.connect(ctx)
+	return err
+}
+
+func (p *publisher) close() error {
+	p.mu.Lock()
+	p.closed = true
+	s := p.session
+	p.session = nil
+	p.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
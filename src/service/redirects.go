@@ -2,10 +2,8 @@ package service
 
 import (
 	"encoding/json"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	redirect_service "github.com/linkit360/go-partners/service"
 )
@@ -15,102 +13,52 @@ type EventNotifyRedirects struct {
 	EventData redirect_service.DestinationHit `json:"event_data,omitempty"`
 }
 
-func processRedirects(deliveries <-chan amqp.Delivery) {
+type redirectsHandler struct{}
 
-	for msg := range deliveries {
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.Redirects.Name,
-		})
-		var query string
-		var e EventNotifyRedirects
-		var t redirect_service.DestinationHit
-		var begin time.Time
-
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.UserActions.Dropped.Inc()
-
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("failed")
-			goto ack
-		}
-
-		t = e.EventData
-		if t.Tid == "" {
-			svc.m.UserActions.Dropped.Inc()
-			svc.m.UserActions.Empty.Inc()
+func (redirectsHandler) Queue() string {
+	return svc.sConfig.Queue.Redirects.Name
+}
 
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("discarding")
-			goto ack
-		}
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid": t.Tid,
-		})
-		if len(t.Msisdn) > 32 {
-			logCtx.WithFields(log.Fields{
-				"msisdn": t.Msisdn,
-				"error":  "strange msisdn",
-			}).Error("")
-			t.Msisdn = t.Msisdn[:31]
-		}
-		begin = time.Now()
-		query = "INSERT INTO tr.destinations_hits (" +
-			"id_partner, " +
-			"id_destination, " +
-			"tid, " +
-			"sent_at, " +
-			"destination, " +
-			"msisdn , " +
-			"price_per_hit, " +
-			"operator_code," +
-			"country_code" +
-			") values ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+func (redirectsHandler) Metrics() *queueMetrics {
+	return &svc.m.Redirects.queueMetrics
+}
 
-		if _, err := svc.db.Exec(query,
-			t.PartnerId,
-			t.DestinationId,
-			t.Tid,
-			t.SentAt,
-			t.Destination,
-			t.Msisdn,
-			t.PricePerHit,
-			t.OperatorCode,
-			t.CountryCode,
-		); err != nil {
-			svc.m.Common.DBErrors.Inc()
-			svc.m.UserActions.AddToDBErrors.Inc()
-			logCtx.WithFields(log.Fields{
-				"query": query,
-				"msg":   "requeue",
-				"error": err.Error(),
-			}).Error("failed")
-			time.Sleep(time.Second)
-			msg.Nack(false, true)
-			continue
-		}
+func (redirectsHandler) Decode(body []byte) (*Event, error) {
+	var e EventNotifyRedirects
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: &e.EventData,
+	}, nil
+}
 
-		svc.m.UserActions.AddToDbSuccess.Inc()
-		svc.m.UserActions.AddToDBDuration.Observe(time.Since(begin).Seconds())
-		svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+func (redirectsHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*redirect_service.DestinationHit)
 
+	if t.Tid == "" {
+		return errEmptyMessage
+	}
+	if len(t.Msisdn) > 32 {
 		logCtx.WithFields(log.Fields{
-			"took": time.Since(begin).String(),
-		}).Info("success")
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
+			"msisdn": t.Msisdn,
+			"error":  "strange msisdn",
+		}).Error("")
+		t.Msisdn = t.Msisdn[:31]
 	}
+	return nil
+}
+
+func (redirectsHandler) Persist(e *Event) error {
+	t := e.Data.(*redirect_service.DestinationHit)
+	_, err := svc.sinks.Redirects.write(func(s Sink) (bool, error) {
+		return false, s.Redirect(t)
+	})
+	return err
+}
+
+func (redirectsHandler) Publish(e *Event) error {
+	return nil
 }
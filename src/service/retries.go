@@ -0,0 +1,160 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	rec "github.com/linkit360/go-utils/rec"
+)
+
+// RetriesConfig configures the sweeper moving the retries older than
+// their keep_days to retries_expired. A retry is removed by its service,
+// the sweeper catches the ones left by a crashed service
+type RetriesConfig struct {
+	// SweepMinutes is the period of the expiry sweep, 0 disables it
+	SweepMinutes int `yaml:"sweep_minutes" default:"60"`
+	// BatchSize is how many retries are moved in one transaction
+	BatchSize int `yaml:"batch_size" default:"500"`
+}
+
+const retryExpired = "expired"
+
+func newRetriesSweeper(conf RetriesConfig) *sweeper {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 500
+	}
+	return newSweeper(time.Duration(conf.SweepMinutes)*time.Minute, func() {
+		sweepRetries(conf.BatchSize)
+	})
+}
+
+// sweepRetries moves the expired retries in batches until there are less than a batch left.
+// Without the outbox the outflow of the batch is published once it is committed,
+// the sweep stops on the first failed publish
+func sweepRetries(batchSize int) {
+	begin := time.Now()
+	var total int
+	for {
+		var count int
+		reports, err := reportInTx(sql.LevelReadCommitted, func(db dbExecutor) (reports []reporterEvent, err error) {
+			reports, count, err = expireRetries(db, batchSize)
+			return
+		})
+		if err != nil {
+			svc.m.Common.DBErrors.Inc(classifyDBError(err))
+			log.WithField("error", err.Error()).Error("retries sweep")
+			break
+		}
+		total += count
+		if err = publishSwept(reports); err != nil {
+			svc.m.Common.Errors.Inc()
+			log.WithField("error", err.Error()).Error("retries sweep")
+			break
+		}
+		if count < batchSize {
+			break
+		}
+	}
+
+	svc.m.MTManager.RetriesSweptRows.Observe(float64(total))
+	svc.m.MTManager.RetriesSweepDuration.Observe(time.Since(begin).Seconds())
+	if total > 0 {
+		log.WithFields(log.Fields{
+			"count": total,
+			"took":  time.Since(begin).String(),
+		}).Info("expired retries moved")
+	}
+}
+
+// publishSwept publishes the outflow of the committed batch
+func publishSwept(reports []reporterEvent) error {
+	for _, r := range reports {
+		if err := publishReporter(r.queue, r.collect); err != nil {
+			return fmt.Errorf("publish outflow: tid %s: %s", r.collect.Tid, err.Error())
+		}
+	}
+	return nil
+}
+
+// expireRetries moves one batch with the status expired. Skip locked leaves
+// the retries being removed by the RemoveRetry task
+func expireRetries(db dbExecutor, limit int) (reports []reporterEvent, count int, err error) {
+	query := fmt.Sprintf(`WITH expired AS (
+	DELETE FROM %sretries WHERE id IN (
+		SELECT id FROM %sretries
+		WHERE created_at < (CURRENT_TIMESTAMP - keep_days * INTERVAL '1 day')
+		ORDER BY id LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING *
+)
+INSERT INTO %sretries_expired(
+	  status,
+	  tid,
+	  created_at ,
+	  price,
+	  last_pay_attempt_at ,
+	  attempts_count ,
+	  retry_days ,
+	  delay_hours ,
+	  msisdn ,
+	  operator_code ,
+	  country_code ,
+	  id_service ,
+	  id_subscription ,
+	  id_campaign
+)
+SELECT
+	  $2,
+	  tid ,
+	  created_at ,
+	  price,
+	  last_pay_attempt_at ,
+	  attempts_count ,
+	  retry_days ,
+	  delay_hours ,
+	  msisdn ,
+	  operator_code ,
+	  country_code ,
+	  id_service ,
+	  id_subscription ,
+	  id_campaign
+FROM expired
+RETURNING tid, msisdn, id_campaign, operator_code, price, attempts_count, id_subscription`,
+		svc.dbConf.TablePrefix,
+		svc.dbConf.TablePrefix,
+		svc.dbConf.TablePrefix,
+	)
+	rows, err := db.Query(query, limit, retryExpired)
+	if err != nil {
+		err = newDBError("db.Query", err, query)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := rec.Record{Result: retryExpired}
+		if err = rows.Scan(
+			&r.Tid,
+			&r.Msisdn,
+			&r.CampaignId,
+			&r.OperatorCode,
+			&r.Price,
+			&r.AttemptsCount,
+			&r.SubscriptionId,
+		); err != nil {
+			err = newDBError("rows.Scan", err, "")
+			return
+		}
+		reports = append(reports, outflowReport(r))
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		err = newDBError("rows.Err", err, "")
+		return
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSweepRetriesCommitsBeforePublish(t *testing.T) {
+	columns := []string{"tid", "msisdn", "id_campaign", "operator_code", "price", "attempts_count", "id_subscription"}
+	fake, db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		if strings.HasPrefix(query, "WITH expired AS") {
+			return fakeResult{columns: columns, rows: [][]driver.Value{
+				{"tid-1", "79000000001", "campaign-a", int64(41001), int64(15), int64(3), int64(11)},
+				{"tid-2", "79000000002", "campaign-a", int64(41001), int64(15), int64(1), int64(12)},
+			}}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	})
+	defer db.Close()
+	useTestDB(t, db)
+	// the broker is down: the batch is moved anyway
+	svc.publisher = &publisher{closed: true}
+
+	sweepRetries(2)
+
+	if batches := fake.executed("WITH expired AS"); len(batches) != 1 {
+		t.Errorf("batches = %d, want the sweep stopped after the first", len(batches))
+	}
+	if commits := fake.committed(); commits != 1 {
+		t.Errorf("commits = %d, want the batch committed before the publish", commits)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	redirect_service "github.com/linkit360/go-partners/service"
+	"github.com/linkit360/go-pixel/src/notifier"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+const (
+	sinkPostgres   = "postgres"
+	sinkFile       = "file"
+	sinkClickHouse = "clickhouse"
+)
+
+// Sink stores the append-only events, the handlers validate them and
+// publish to the reporter. Methods returning duplicate tell whether
+// the event with the same tid has been written before
+type Sink interface {
+	Name() string
+	// AccessHits returns tids of the hits written before
+	AccessHits(hits []*accessCampaignHit) (duplicates map[string]bool, err error)
+	ContentSent(t *structs.ContentSentProperties) (duplicate bool, err error)
+	UserAction(t *rbmq.UserActionsNotify) error
+	OperatorLog(t *OperatorTransactionLog) error
+	PixelTransaction(t *notifier.Pixel) (duplicate bool, err error)
+	Redirect(t *redirect_service.DestinationHit) error
+	Transaction(r rec.Record) (duplicate bool, err error)
+	Close() error
+}
+
+type SinksConfig struct {
+	File       FileSinkConfig       `yaml:"file"`
+	ClickHouse ClickHouseSinkConfig `yaml:"clickhouse"`
+}
+
+// sinkSet is the sinks of a queue. The first sink decides about duplicates:
+// the event it has written before is not passed to the others
+type sinkSet []Sink
+
+// write calls fn for every sink. An error of the first sink requeues the message,
+// the others are best effort: the event is committed to the first sink already
+// and the requeue would write it again, their errors are logged and counted
+func (s sinkSet) write(fn func(Sink) (bool, error)) (duplicate bool, err error) {
+	for i, sink := range s {
+		dup, err := fn(sink)
+		if err != nil {
+			if i == 0 {
+				return false, err
+			}
+			sinkFailed(sink, err)
+			continue
+		}
+		if i == 0 && dup {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outboxed reports whether the reporter events are written to the outbox
+// by the postgres sink, the handler must not publish them then
+func (s sinkSet) outboxed() bool {
+	if !svc.outbox.enabled() {
+		return false
+	}
+	for _, sink := range s {
+		if sink.Name() == sinkPostgres {
+			return true
+		}
+	}
+	return false
+}
+
+func (s sinkSet) accessHits(hits []*accessCampaignHit) (map[string]bool, error) {
+	var duplicates map[string]bool
+	for i, sink := range s {
+		if i > 0 && len(duplicates) > 0 {
+			fresh := make([]*accessCampaignHit, 0, len(hits))
+			for _, t := range hits {
+				if !duplicates[t.Tid] {
+					fresh = append(fresh, t)
+				}
+			}
+			hits = fresh
+		}
+		if len(hits) == 0 {
+			break
+		}
+		dups, err := sink.AccessHits(hits)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			sinkFailed(sink, err)
+			continue
+		}
+		if i == 0 {
+			duplicates = dups
+		}
+	}
+	return duplicates, nil
+}
+
+func sinkFailed(sink Sink, err error) {
+	svc.m.Common.SinkErrors.Inc()
+	log.WithFields(log.Fields{
+		"sink":  sink.Name(),
+		"error": err.Error(),
+	}).Error("sink write failed, skipped")
+}
+
+type sinks struct {
+	all            []Sink
+	AccessCampaign sinkSet
+	ContentSent    sinkSet
+	UserActions    sinkSet
+	Operator       sinkSet
+	Pixels         sinkSet
+	Redirects      sinkSet
+	MTManager      sinkSet
+}
+
+func newSinks(conf ServiceConfig) sinks {
+	created := make(map[string]Sink)
+	s := sinks{}
+	set := func(queue QueueConfig) sinkSet {
+		names := queue.Sinks
+		if len(names) == 0 {
+			names = []string{sinkPostgres}
+		}
+		res := make(sinkSet, 0, len(names))
+		for _, name := range names {
+			sink, ok := created[name]
+			if !ok {
+				sink = newSink(name, conf.Sinks)
+				created[name] = sink
+				s.all = append(s.all, sink)
+			}
+			res = append(res, sink)
+		}
+		return res
+	}
+	s.AccessCampaign = set(conf.Queue.AccessCampaign)
+	s.ContentSent = set(conf.Queue.ContentSent)
+	s.UserActions = set(conf.Queue.UserActions)
+	s.Operator = set(conf.Queue.TransactionLog)
+	s.Pixels = set(conf.Queue.PixelSent)
+	s.Redirects = set(conf.Queue.Redirects)
+	s.MTManager = set(conf.Queue.MTManager)
+	return s
+}
+
+func newSink(name string, conf SinksConfig) Sink {
+	switch name {
+	case sinkPostgres:
+		return postgresSink{}
+	case sinkFile:
+		return newFileSink(conf.File)
+	case sinkClickHouse:
+		return newClickHouseSink(conf.ClickHouse)
+	}
+	log.WithField("sink", name).Fatal("unknown sink")
+	return nil
+}
+
+func (s sinks) close() {
+	for _, sink := range s.all {
+		if err := sink.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"sink":  sink.Name(),
+				"error": err.Error(),
+			}).Error("close sink")
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	redirect_service "github.com/linkit360/go-partners/service"
+	"github.com/linkit360/go-pixel/src/notifier"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+// ClickHouseSinkConfig configures the analytics copy of access hits and pixel
+// transactions. Rows are sent over the HTTP interface as JSONEachRow
+type ClickHouseSinkConfig struct {
+	URL         string `yaml:"url" default:"http://127.0.0.1:8123/"`
+	User        string `yaml:"user" default:"default"`
+	Password    string `yaml:"password"`
+	Database    string `yaml:"database" default:"default"`
+	AccessTable string `yaml:"access_table" default:"campaigns_access"`
+	PixelTable  string `yaml:"pixel_table" default:"pixel_transactions"`
+	// BatchRows or FlushMs, whichever comes first, triggers the insert
+	BatchRows int `yaml:"batch_rows" default:"1000"`
+	FlushMs   int `yaml:"flush_ms" default:"1000"`
+	// BufferRows are kept while ClickHouse is slow, new rows are dropped when it is full
+	BufferRows int `yaml:"buffer_rows" default:"100000"`
+	Retries    int `yaml:"retries" default:"3"`
+	TimeoutMs  int `yaml:"timeout_ms" default:"5000"`
+}
+
+type clickHouseRow struct {
+	table string
+	data  map[string]interface{}
+}
+
+// clickHouseTables is the number of tables the rows are inserted to
+const clickHouseTables = 2
+
+// clock is the timers of the sink, tests replace it
+type clock interface {
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// clickHouseSink only queues the rows: they are inserted in batches
+// by its own goroutine, so ClickHouse never delays or fails the ack.
+// Rows are lost if ClickHouse is down longer than the retries
+type clickHouseSink struct {
+	// batched is the number of rows taken from the channel and not inserted yet,
+	// it is first for the 64-bit alignment of the atomic access
+	batched int64
+	conf    ClickHouseSinkConfig
+	client  *http.Client
+	clock   clock
+	rows    chan clickHouseRow
+	quit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newClickHouseSink(conf ClickHouseSinkConfig) *clickHouseSink {
+	return startClickHouseSink(conf, realClock{})
+}
+
+func startClickHouseSink(conf ClickHouseSinkConfig, c clock) *clickHouseSink {
+	if conf.BatchRows <= 0 {
+		conf.BatchRows = 1000
+	}
+	if conf.FlushMs <= 0 {
+		conf.FlushMs = 1000
+	}
+	s := &clickHouseSink{
+		conf: conf,
+		client: &http.Client{
+			Timeout: time.Duration(conf.TimeoutMs) * time.Millisecond,
+		},
+		clock: c,
+		rows:  make(chan clickHouseRow, conf.BufferRows),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *clickHouseSink) Name() string {
+	return sinkClickHouse
+}
+
+func (s *clickHouseSink) add(table string, data map[string]interface{}) {
+	select {
+	case s.rows <- clickHouseRow{table: table, data: data}:
+	default:
+		svc.m.ClickHouse.Dropped.Inc()
+	}
+}
+
+func (s *clickHouseSink) AccessHits(hits []*accessCampaignHit) (map[string]bool, error) {
+	for _, t := range hits {
+		values := t.values()
+		data := make(map[string]interface{}, len(values))
+		for i, column := range accessCampaignColumns {
+			data[column] = values[i]
+		}
+		s.add(s.conf.AccessTable, data)
+	}
+	return nil, nil
+}
+
+func (s *clickHouseSink) PixelTransaction(t *notifier.Pixel) (bool, error) {
+	s.add(s.conf.PixelTable, map[string]interface{}{
+		"sent_at":       t.SentAt,
+		"tid":           t.Tid,
+		"msisdn":        t.Msisdn,
+		"pixel":         t.Pixel,
+		"endpoint":      t.Endpoint,
+		"id_campaign":   t.CampaignCode,
+		"operator_code": t.OperatorCode,
+		"country_code":  t.CountryCode,
+		"publisher":     t.Publisher,
+		"response_code": t.ResponseCode,
+	})
+	return false, nil
+}
+
+// other events are not sent to ClickHouse
+
+func (s *clickHouseSink) ContentSent(t *structs.ContentSentProperties) (bool, error) {
+	return false, nil
+}
+
+func (s *clickHouseSink) UserAction(t *rbmq.UserActionsNotify) error {
+	return nil
+}
+
+func (s *clickHouseSink) OperatorLog(t *OperatorTransactionLog) error {
+	return nil
+}
+
+func (s *clickHouseSink) Redirect(t *redirect_service.DestinationHit) error {
+	return nil
+}
+
+func (s *clickHouseSink) Transaction(r rec.Record) (bool, error) {
+	return false, nil
+}
+
+// Close inserts the queued rows. It waits no longer than the retries of the insert
+// in progress and of the last insert to every table take
+func (s *clickHouseSink) Close() error {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-s.clock.After((clickHouseTables + 1) * s.retryBudget()):
+		return fmt.Errorf("%d rows left", len(s.rows)+int(atomic.LoadInt64(&s.batched)))
+	}
+}
+
+// retryBudget is the longest time one insert takes with all the retries
+func (s *clickHouseSink) retryBudget() time.Duration {
+	budget := time.Duration(s.conf.Retries+1) * s.client.Timeout
+	for attempt := 0; attempt < s.conf.Retries; attempt++ {
+		budget += retryDelay(attempt)
+	}
+	return budget
+}
+
+func retryDelay(attempt int) time.Duration {
+	return time.Duration(attempt+1) * time.Second
+}
+
+func (s *clickHouseSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Duration(s.conf.FlushMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := make(map[string][]map[string]interface{})
+	count := 0
+	flush := func() {
+		for table, rows := range batch {
+			s.insert(table, rows)
+			atomic.AddInt64(&s.batched, -int64(len(rows)))
+		}
+		batch = make(map[string][]map[string]interface{})
+		count = 0
+	}
+	for {
+		select {
+		case row := <-s.rows:
+			atomic.AddInt64(&s.batched, 1)
+			batch[row.table] = append(batch[row.table], row.data)
+			count++
+			if count >= s.conf.BatchRows {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.quit:
+			for {
+				select {
+				case row := <-s.rows:
+					atomic.AddInt64(&s.batched, 1)
+					batch[row.table] = append(batch[row.table], row.data)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// insert sends rows, retrying failed requests
+func (s *clickHouseSink) insert(table string, rows []map[string]interface{}) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			svc.m.ClickHouse.Errors.Inc()
+			log.WithFields(log.Fields{
+				"table": table,
+				"error": err.Error(),
+			}).Error("clickhouse encode row")
+			return
+		}
+	}
+	logCtx := log.WithFields(log.Fields{
+		"table": table,
+		"rows":  len(rows),
+	})
+
+	for attempt := 0; ; attempt++ {
+		begin := time.Now()
+		err := s.post(table, body.Bytes())
+		if err == nil {
+			svc.m.ClickHouse.Rows.Observe(float64(len(rows)))
+			svc.m.ClickHouse.InsertDuration.Observe(time.Since(begin).Seconds())
+			logCtx.WithField("took", time.Since(begin).String()).Debug("clickhouse insert")
+			return
+		}
+		svc.m.ClickHouse.Errors.Inc()
+		if attempt >= s.conf.Retries {
+			svc.m.ClickHouse.Lost.Observe(float64(len(rows)))
+			logCtx.WithField("error", err.Error()).Error("clickhouse insert failed, rows lost")
+			return
+		}
+		logCtx.WithFields(log.Fields{
+			"error":   err.Error(),
+			"attempt": attempt + 1,
+		}).Warn("clickhouse insert failed, retry")
+		s.clock.Sleep(retryDelay(attempt))
+	}
+}
+
+func (s *clickHouseSink) post(table string, body []byte) error {
+	params := url.Values{}
+	params.Set("database", s.conf.Database)
+	params.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+	// time.Time is encoded as RFC 3339
+	params.Set("date_time_input_format", "best_effort")
+
+	req, err := http.NewRequest("POST", s.conf.URL+"?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-ClickHouse-User", s.conf.User)
+	req.Header.Set("X-ClickHouse-Key", s.conf.Password)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/linkit360/go-pixel/src/notifier"
+)
+
+type clickHouseRequest struct {
+	query url.Values
+	user  string
+	key   string
+	rows  []map[string]interface{}
+}
+
+// clickHouseServer records the inserts and answers with the status,
+// once release is closed when it is set
+type clickHouseServer struct {
+	*httptest.Server
+	status   int
+	release  chan struct{}
+	requests chan clickHouseRequest
+}
+
+func newClickHouseServer(t *testing.T, status int, release chan struct{}) *clickHouseServer {
+	s := &clickHouseServer{
+		status:   status,
+		release:  release,
+		requests: make(chan clickHouseRequest, 100),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %s", err.Error())
+		}
+		req := clickHouseRequest{
+			query: r.URL.Query(),
+			user:  r.Header.Get("X-ClickHouse-User"),
+			key:   r.Header.Get("X-ClickHouse-Key"),
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			row := make(map[string]interface{})
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Errorf("JSONEachRow line %q: %s", scanner.Text(), err.Error())
+			}
+			req.rows = append(req.rows, row)
+		}
+		s.requests <- req
+		if s.release != nil {
+			<-s.release
+		}
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+// next waits for the insert, the timeout only keeps a broken sink from hanging the test
+func (s *clickHouseServer) next(t *testing.T) clickHouseRequest {
+	select {
+	case req := <-s.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no insert")
+	}
+	return clickHouseRequest{}
+}
+
+// none checks that no insert is left, the sink must be closed before
+func (s *clickHouseServer) none(t *testing.T) {
+	select {
+	case req := <-s.requests:
+		t.Fatalf("unexpected insert of %d rows", len(req.rows))
+	default:
+	}
+}
+
+// fakeClock records the retry pauses without sleeping,
+// the Close timer fires when the test sends to fire
+type fakeClock struct {
+	mu     sync.Mutex
+	sleeps []time.Duration
+	after  chan time.Duration
+	fire   chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		after: make(chan time.Duration, 10),
+		fire:  make(chan time.Time, 1),
+	}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.after <- d
+	return c.fire
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+}
+
+// summarySum returns the sum of the observed values
+func summarySum(t *testing.T, s prometheus.Summary) float64 {
+	var metric dto.Metric
+	if err := s.Write(&metric); err != nil {
+		t.Fatalf("summary: %s", err.Error())
+	}
+	return metric.GetSummary().GetSampleSum()
+}
+
+func testClickHouseConfig(url string) ClickHouseSinkConfig {
+	return ClickHouseSinkConfig{
+		URL:         url + "/",
+		User:        "qlistener",
+		Password:    "secret",
+		Database:    "analytics",
+		AccessTable: "campaigns_access",
+		PixelTable:  "pixel_transactions",
+		BatchRows:   1000,
+		FlushMs:     60000,
+		BufferRows:  100,
+		TimeoutMs:   1000,
+	}
+}
+
+func testPixel(tid string) *notifier.Pixel {
+	return &notifier.Pixel{
+		Tid:          tid,
+		Msisdn:       "79001234567",
+		CampaignCode: "290",
+		OperatorCode: 41001,
+		CountryCode:  7,
+		Pixel:        "px",
+		Publisher:    "pub",
+		Endpoint:     "http://partner/px",
+		ResponseCode: 200,
+		SentAt:       time.Now().UTC(),
+	}
+}
+
+func TestClickHouseSinkFlushesFullBatch(t *testing.T) {
+	initTestMetrics()
+	server := newClickHouseServer(t, http.StatusOK, nil)
+	defer server.Close()
+
+	conf := testClickHouseConfig(server.URL)
+	conf.BatchRows = 3
+	s := startClickHouseSink(conf, newFakeClock())
+
+	rows := summarySum(t, svc.m.ClickHouse.Rows)
+	for _, tid := range []string{"tid-1", "tid-2", "tid-3"} {
+		if _, err := s.PixelTransaction(testPixel(tid)); err != nil {
+			t.Fatalf("PixelTransaction: %s", err.Error())
+		}
+	}
+	// the flush timer is far away: the first insert is the full batch
+	req := server.next(t)
+	if got := req.query.Get("query"); got != "INSERT INTO pixel_transactions FORMAT JSONEachRow" {
+		t.Errorf("query = %q", got)
+	}
+	if got := req.query.Get("database"); got != "analytics" {
+		t.Errorf("database = %q", got)
+	}
+	if req.user != "qlistener" || req.key != "secret" {
+		t.Errorf("credentials = %q %q", req.user, req.key)
+	}
+	if len(req.rows) != 3 {
+		t.Fatalf("rows = %d, want 3", len(req.rows))
+	}
+	for i, tid := range []string{"tid-1", "tid-2", "tid-3"} {
+		if req.rows[i]["tid"] != tid {
+			t.Errorf("row %d tid = %v, want %s", i, req.rows[i]["tid"], tid)
+		}
+		if req.rows[i]["operator_code"] != float64(41001) {
+			t.Errorf("row %d operator_code = %v", i, req.rows[i]["operator_code"])
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	server.none(t)
+	if got := summarySum(t, svc.m.ClickHouse.Rows) - rows; got != 3 {
+		t.Errorf("inserted rows grew by %v, want 3", got)
+	}
+}
+
+func TestClickHouseSinkFlushesOnTimer(t *testing.T) {
+	initTestMetrics()
+	server := newClickHouseServer(t, http.StatusOK, nil)
+	defer server.Close()
+
+	conf := testClickHouseConfig(server.URL)
+	conf.FlushMs = 50
+	s := newClickHouseSink(conf)
+	defer s.Close()
+
+	hit := &accessCampaignHit{}
+	hit.Tid = "tid-hit"
+	hit.Msisdn = "79001234567"
+	hit.ClientIp = "81.2.69.142"
+	hit.IpInfo.Latitude = 53
+	hit.IpInfo.Longitude = -1.1333
+	if _, err := s.AccessHits([]*accessCampaignHit{hit}); err != nil {
+		t.Fatalf("AccessHits: %s", err.Error())
+	}
+	if _, err := s.PixelTransaction(testPixel("tid-pixel")); err != nil {
+		t.Fatalf("PixelTransaction: %s", err.Error())
+	}
+
+	// one insert per table
+	tables := make(map[string]clickHouseRequest)
+	for i := 0; i < 2; i++ {
+		req := server.next(t)
+		tables[req.query.Get("query")] = req
+	}
+	access, ok := tables["INSERT INTO campaigns_access FORMAT JSONEachRow"]
+	if !ok || len(access.rows) != 1 {
+		t.Fatalf("no access insert of one row: %v", tables)
+	}
+	row := access.rows[0]
+	if len(row) != len(accessCampaignColumns) {
+		t.Errorf("columns = %d, want %d", len(row), len(accessCampaignColumns))
+	}
+	if row["tid"] != "tid-hit" || row["client_ip"] != "81.2.69.142" {
+		t.Errorf("row = %v", row)
+	}
+	if row["geoip_latitude"] != float64(53) || row["geoip_longitude"] != -1.1333 {
+		t.Errorf("geoip = %v %v", row["geoip_latitude"], row["geoip_longitude"])
+	}
+	pixel, ok := tables["INSERT INTO pixel_transactions FORMAT JSONEachRow"]
+	if !ok || len(pixel.rows) != 1 || pixel.rows[0]["tid"] != "tid-pixel" {
+		t.Fatalf("no pixel insert of tid-pixel: %v", tables)
+	}
+}
+
+func TestClickHouseSinkRetriesServerError(t *testing.T) {
+	initTestMetrics()
+	server := newClickHouseServer(t, http.StatusInternalServerError, nil)
+	defer server.Close()
+
+	conf := testClickHouseConfig(server.URL)
+	conf.BatchRows = 1
+	conf.Retries = 2
+	clock := newFakeClock()
+	s := startClickHouseSink(conf, clock)
+
+	lost := summarySum(t, svc.m.ClickHouse.Lost)
+	for _, tid := range []string{"tid-1", "tid-2"} {
+		duplicate, err := s.PixelTransaction(testPixel(tid))
+		if err != nil || duplicate {
+			t.Fatalf("PixelTransaction = %v, %v", duplicate, err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		server.next(t)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	server.none(t)
+	if got := summarySum(t, svc.m.ClickHouse.Lost) - lost; got != 2 {
+		t.Errorf("lost_inserted rows grew by %v, want 2", got)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, time.Second, 2 * time.Second}
+	if fmt.Sprint(clock.sleeps) != fmt.Sprint(want) {
+		t.Errorf("retry pauses = %v, want %v", clock.sleeps, want)
+	}
+}
+
+func TestClickHouseSinkCloseIsBoundedByRetries(t *testing.T) {
+	initTestMetrics()
+	release := make(chan struct{})
+	server := newClickHouseServer(t, http.StatusOK, release)
+	defer server.Close()
+
+	conf := testClickHouseConfig(server.URL)
+	conf.BatchRows = 1
+	conf.Retries = 2
+	clock := newFakeClock()
+	s := startClickHouseSink(conf, clock)
+
+	// ClickHouse hangs on the first insert, the rows are only queued
+	for _, tid := range []string{"tid-1", "tid-2", "tid-3"} {
+		if _, err := s.PixelTransaction(testPixel(tid)); err != nil {
+			t.Fatalf("PixelTransaction: %s", err.Error())
+		}
+	}
+	server.next(t)
+
+	closed := make(chan error)
+	go func() {
+		closed <- s.Close()
+	}()
+	// the insert in progress and one per table, each with 3 attempts of 1s
+	// and the pauses of 1s and 2s
+	if wait := <-clock.after; wait != 18*time.Second {
+		t.Errorf("Close waits %s, want 18s", wait)
+	}
+	clock.fire <- time.Now()
+	err := <-closed
+	if err == nil || err.Error() != "3 rows left" {
+		t.Errorf("Close = %v, want the batched row and the queued ones left", err)
+	}
+
+	close(release)
+	<-s.done
+}
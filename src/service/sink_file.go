@@ -0,0 +1,182 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	redirect_service "github.com/linkit360/go-partners/service"
+	"github.com/linkit360/go-pixel/src/notifier"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+// FileSinkConfig configures the newline-delimited JSON archive.
+// Every event type has its own file, it is rotated once it is
+// bigger than max_size_mb or older than rotate_minutes
+type FileSinkConfig struct {
+	Dir           string `yaml:"dir" default:"/var/lib/qlistener/archive"`
+	MaxSizeMb     int    `yaml:"max_size_mb" default:"100"`
+	RotateMinutes int    `yaml:"rotate_minutes" default:"60"`
+}
+
+// fileSink writes events as NDJSON for the cold archive,
+// it does not check duplicates
+type fileSink struct {
+	conf  FileSinkConfig
+	mu    sync.Mutex
+	files map[string]*rotatingFile
+}
+
+func newFileSink(conf FileSinkConfig) *fileSink {
+	return &fileSink{
+		conf:  conf,
+		files: make(map[string]*rotatingFile),
+	}
+}
+
+func (s *fileSink) Name() string {
+	return sinkFile
+}
+
+func (s *fileSink) file(event string) *rotatingFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[event]
+	if !ok {
+		f = &rotatingFile{
+			path:    filepath.Join(s.conf.Dir, event),
+			maxSize: int64(s.conf.MaxSizeMb) * 1024 * 1024,
+			maxAge:  time.Duration(s.conf.RotateMinutes) * time.Minute,
+		}
+		s.files[event] = f
+	}
+	return f
+}
+
+func (s *fileSink) write(event string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	return s.file(event).write(append(line, '\n'))
+}
+
+func (s *fileSink) AccessHits(hits []*accessCampaignHit) (map[string]bool, error) {
+	for _, t := range hits {
+		if err := s.write("access_campaign", t); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *fileSink) ContentSent(t *structs.ContentSentProperties) (bool, error) {
+	return false, s.write("content_sent", t)
+}
+
+func (s *fileSink) UserAction(t *rbmq.UserActionsNotify) error {
+	return s.write("user_actions", t)
+}
+
+func (s *fileSink) OperatorLog(t *OperatorTransactionLog) error {
+	return s.write("operator_transaction_log", t)
+}
+
+func (s *fileSink) PixelTransaction(t *notifier.Pixel) (bool, error) {
+	return false, s.write("pixel_transactions", t)
+}
+
+func (s *fileSink) Redirect(t *redirect_service.DestinationHit) error {
+	return s.write("destinations_hits", t)
+}
+
+func (s *fileSink) Transaction(r rec.Record) (bool, error) {
+	return false, s.write("transactions", r)
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, f := range s.files {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// rotatingFile appends lines to path-<opened at>.ndjson. Rotation is
+// checked on write, so an idle file stays open until the next event
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func (rf *rotatingFile) write(line []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil ||
+		(rf.maxSize > 0 && rf.size+int64(len(line)) > rf.maxSize) ||
+		(rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge) {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.f.Write(line)
+	rf.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write %s: %s", rf.f.Name(), err.Error())
+	}
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if rf.f != nil {
+		if err := rf.f.Close(); err != nil {
+			return fmt.Errorf("close %s: %s", rf.f.Name(), err.Error())
+		}
+		rf.f = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return fmt.Errorf("mkdir: %s", err.Error())
+	}
+	now := time.Now()
+	name := rf.path + "-" + now.Format("20060102-150405.000") + ".ndjson"
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s: %s", name, err.Error())
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat %s: %s", name, err.Error())
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = now
+	return nil
+}
+
+func (rf *rotatingFile) close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
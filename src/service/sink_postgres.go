@@ -0,0 +1,352 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	redirect_service "github.com/linkit360/go-partners/service"
+	"github.com/linkit360/go-pixel/src/notifier"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+// postgresSink is the default sink, it writes to svc.db
+type postgresSink struct{}
+
+func (postgresSink) Name() string {
+	return sinkPostgres
+}
+
+// db is closed on shutdown after the consumers are stopped
+func (postgresSink) Close() error {
+	return nil
+}
+
+// insert writes the event row and its reporter events to the outbox
+// in one transaction, it returns false for a duplicate
+func (postgresSink) insert(d *dedup, tid string, reports []reporterEvent, query string, args ...interface{}) (inserted bool, err error) {
+	if err = inTx(func(db dbExecutor) (err error) {
+		if inserted, err = d.insert(db, tid, query, args...); err != nil || !inserted {
+			return
+		}
+		return svc.outbox.add(db, reports)
+	}); err != nil {
+		return false, err
+	}
+	if inserted {
+		d.mark(tid)
+	}
+	return
+}
+
+// AccessHits writes hits with one multi-row insert
+func (postgresSink) AccessHits(hits []*accessCampaignHit) (map[string]bool, error) {
+	d := svc.dedup.AccessCampaign
+	begin := time.Now()
+
+	duplicates := make(map[string]bool)
+	var written []*accessCampaignHit
+	rows := make([]string, 0, len(hits))
+	args := make([]interface{}, 0, len(hits)*len(accessCampaignColumns))
+	for _, t := range hits {
+		if d.written(t.Tid) {
+			duplicates[t.Tid] = true
+			continue
+		}
+		values := t.values()
+		placeholders := make([]string, len(values))
+		for i := range values {
+			placeholders[i] = fmt.Sprintf("$%d", len(args)+i+1)
+		}
+		args = append(args, values...)
+		rows = append(rows, "("+strings.Join(placeholders, ", ")+")")
+		written = append(written, t)
+	}
+	if len(written) == 0 {
+		return duplicates, nil
+	}
+	query := fmt.Sprintf("INSERT INTO %scampaigns_access (%s) VALUES %s",
+		svc.dbConf.TablePrefix,
+		strings.Join(accessCampaignColumns, ", "),
+		strings.Join(rows, ", "),
+	) + d.onConflict()
+
+	if err := inTx(func(db dbExecutor) error {
+		if err := insertHits(db, d, query, args, written, duplicates); err != nil {
+			return err
+		}
+		var reports []reporterEvent
+		for _, t := range written {
+			if !duplicates[t.Tid] {
+				reports = append(reports, hitReport(t))
+			}
+		}
+		return svc.outbox.add(db, reports)
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, t := range written {
+		if !duplicates[t.Tid] {
+			d.mark(t.Tid)
+		}
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return duplicates, nil
+}
+
+// insertHits runs the multi-row insert, hits skipped on conflict are added to duplicates
+func insertHits(db dbExecutor, d *dedup, query string, args []interface{}, written []*accessCampaignHit, duplicates map[string]bool) error {
+	if d.conf.Mode != dedupConflict {
+		if _, err := db.Exec(query, args...); err != nil {
+			return newDBError(fmt.Sprintf("db.Exec %d rows", len(written)), err, query)
+		}
+		return nil
+	}
+
+	// skipped rows are not returned
+	query = query + " RETURNING tid"
+	dbRows, err := db.Query(query, args...)
+	if err != nil {
+		return newDBError(fmt.Sprintf("db.Query %d rows", len(written)), err, query)
+	}
+	defer dbRows.Close()
+
+	inserted := make(map[string]bool, len(written))
+	for dbRows.Next() {
+		var tid string
+		if err := dbRows.Scan(&tid); err != nil {
+			return newDBError("rows.Scan", err, "")
+		}
+		inserted[tid] = true
+	}
+	if err := dbRows.Err(); err != nil {
+		return newDBError("rows.Err", err, "")
+	}
+	for _, t := range written {
+		if !inserted[t.Tid] {
+			duplicates[t.Tid] = true
+		}
+	}
+	return nil
+}
+
+func (p postgresSink) ContentSent(t *structs.ContentSentProperties) (bool, error) {
+	begin := time.Now()
+	query := fmt.Sprintf("INSERT INTO %scontent_sent ("+
+		"sent_at, "+
+		"msisdn, "+
+		"tid, "+
+		"id_campaign, "+
+		"id_service, "+
+		"id_content, "+
+		"id_subscription, "+
+		"country_code, "+
+		"operator_code "+
+		") values ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		svc.dbConf.TablePrefix)
+
+	inserted, err := p.insert(svc.dedup.ContentSent, t.Tid, nil, query,
+		t.SentAt,
+		t.Msisdn,
+		t.Tid,
+		t.CampaignId,
+		t.ServiceCode,
+		t.ContentId,
+		t.SubscriptionId,
+		t.CountryCode,
+		t.OperatorCode,
+	)
+	if err != nil {
+		return false, err
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return !inserted, nil
+}
+
+func (postgresSink) UserAction(t *rbmq.UserActionsNotify) error {
+	begin := time.Now()
+	query := fmt.Sprintf("INSERT INTO %suser_actions ("+
+		"sent_at, "+
+		"id_campaign, "+
+		"msisdn, "+
+		"tid, "+
+		"action, "+
+		"error "+
+		") values ($1, $2, $3, $4, $5, $6)",
+		svc.dbConf.TablePrefix)
+
+	if _, err := svc.db.Exec(query,
+		t.SentAt,
+		t.CampaignId,
+		t.Msisdn,
+		t.Tid,
+		t.Action,
+		t.Error,
+	); err != nil {
+		return newDBError("db.Exec", err, query)
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return nil
+}
+
+func (postgresSink) OperatorLog(t *OperatorTransactionLog) error {
+	begin := time.Now()
+	query := fmt.Sprintf("INSERT INTO %soperator_transaction_log ("+
+		"tid, "+
+		"msisdn, "+
+		"operator_code, "+
+		"country_code, "+
+		"operator_token, "+
+		"operator_time, "+
+		"error, "+
+		"price, "+
+		"id_service, "+
+		"id_subscription, "+
+		"id_campaign, "+
+		"request_body, "+
+		"response_body, "+
+		"response_decision, "+
+		"response_code,  "+
+		"sent_at, "+
+		"notice, "+
+		"type "+
+		")"+
+		" values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, "+
+		"$11, $12, $13, $14, $15, $16, $17, $18)",
+		svc.dbConf.TablePrefix)
+
+	if _, err := svc.db.Exec(query,
+		t.Tid,
+		t.Msisdn,
+		t.OperatorCode,
+		t.CountryCode,
+		t.OperatorToken,
+		t.OperatorTime,
+		t.Error,
+		t.Price,
+		t.ServiceCode,
+		t.SubscriptionId,
+		t.CampaignCode,
+		t.RequestBody,
+		t.ResponseBody,
+		t.ResponseDecision,
+		t.ResponseCode,
+		t.SentAt,
+		t.Notice,
+		t.Type,
+	); err != nil {
+		return newDBError("db.Exec", err, query)
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return nil
+}
+
+func (p postgresSink) PixelTransaction(t *notifier.Pixel) (bool, error) {
+	query := fmt.Sprintf("INSERT INTO %spixel_transactions ( "+
+		"sent_at, "+
+		"tid, "+
+		"msisdn, "+
+		"pixel, "+
+		"endpoint, "+
+		"id_campaign, "+
+		"operator_code, "+
+		"country_code, "+
+		"publisher, "+
+		"response_code "+
+		") VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		svc.dbConf.TablePrefix)
+
+	begin := time.Now()
+	inserted, err := p.insert(svc.dedup.PixelTransaction, t.Tid, []reporterEvent{pixelReport(t)}, query,
+		t.SentAt,
+		t.Tid,
+		t.Msisdn,
+		t.Pixel,
+		t.Endpoint,
+		t.CampaignCode,
+		t.OperatorCode,
+		t.CountryCode,
+		t.Publisher,
+		t.ResponseCode,
+	)
+	if err != nil {
+		return false, err
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return !inserted, nil
+}
+
+func (postgresSink) Redirect(t *redirect_service.DestinationHit) error {
+	begin := time.Now()
+	query := "INSERT INTO tr.destinations_hits (" +
+		"id_partner, " +
+		"id_destination, " +
+		"tid, " +
+		"sent_at, " +
+		"destination, " +
+		"msisdn , " +
+		"price_per_hit, " +
+		"operator_code," +
+		"country_code" +
+		") values ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+	if _, err := svc.db.Exec(query,
+		t.PartnerId,
+		t.DestinationId,
+		t.Tid,
+		t.SentAt,
+		t.Destination,
+		t.Msisdn,
+		t.PricePerHit,
+		t.OperatorCode,
+		t.CountryCode,
+	); err != nil {
+		return newDBError("db.Exec", err, query)
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return nil
+}
+
+func (p postgresSink) Transaction(r rec.Record) (bool, error) {
+	begin := time.Now()
+	query := fmt.Sprintf("INSERT INTO %stransactions ("+
+		"tid, "+
+		"sent_at, "+
+		"msisdn, "+
+		"result, "+
+		"operator_code, "+
+		"country_code, "+
+		"id_service, "+
+		"id_subscription, "+
+		"id_campaign, "+
+		"operator_token, "+
+		"price "+
+		") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		svc.dbConf.TablePrefix,
+	)
+	inserted, err := p.insert(
+		svc.dedup.Transaction,
+		r.Tid,
+		[]reporterEvent{transactionReport(r)},
+		query,
+		r.Tid,
+		r.SentAt,
+		r.Msisdn,
+		r.Result,
+		r.OperatorCode,
+		r.CountryCode,
+		r.ServiceCode,
+		r.SubscriptionId,
+		r.CampaignId,
+		r.OperatorToken,
+		int(r.Price),
+	)
+	if err != nil {
+		return false, err
+	}
+	svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+	return !inserted, nil
+}
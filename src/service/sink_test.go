@@ -0,0 +1,107 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/linkit360/go-pixel/src/notifier"
+)
+
+// fakeSink answers the pixel transactions and the access hits, the other
+// methods of the Sink are not called by the tests
+type fakeSink struct {
+	Sink
+	name       string
+	err        error
+	duplicates map[string]bool
+	written    []string
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) PixelTransaction(t *notifier.Pixel) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	s.written = append(s.written, t.Tid)
+	return s.duplicates[t.Tid], nil
+}
+
+func (s *fakeSink) AccessHits(hits []*accessCampaignHit) (map[string]bool, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	dups := make(map[string]bool)
+	for _, t := range hits {
+		s.written = append(s.written, t.Tid)
+		if s.duplicates[t.Tid] {
+			dups[t.Tid] = true
+		}
+	}
+	return dups, nil
+}
+
+func TestSinkSetWrite(t *testing.T) {
+	initTestMetrics()
+	errSink := errors.New("connection refused")
+	write := func(set sinkSet, tid string) (bool, error) {
+		return set.write(func(s Sink) (bool, error) {
+			return s.PixelTransaction(&notifier.Pixel{Tid: tid})
+		})
+	}
+
+	first := &fakeSink{name: sinkPostgres, err: errSink}
+	second := &fakeSink{name: sinkFile}
+	if _, err := write(sinkSet{first, second}, "tid-1"); err != errSink {
+		t.Errorf("first sink error = %v, want %v", err, errSink)
+	}
+	if len(second.written) != 0 {
+		t.Errorf("written to the second sink after the first failed: %v", second.written)
+	}
+
+	first = &fakeSink{name: sinkPostgres, duplicates: map[string]bool{"tid-dup": true}}
+	second = &fakeSink{name: sinkClickHouse, err: errSink}
+	third := &fakeSink{name: sinkFile}
+	set := sinkSet{first, second, third}
+	if dup, err := write(set, "tid-1"); err != nil || dup {
+		t.Errorf("secondary sink error = %v, %v, want the write to succeed", dup, err)
+	}
+	if len(third.written) != 1 {
+		t.Errorf("sinks after the failed one written %v", third.written)
+	}
+	if dup, err := write(set, "tid-dup"); err != nil || !dup {
+		t.Errorf("duplicate = %v, %v", dup, err)
+	}
+	if len(third.written) != 1 {
+		t.Errorf("duplicate written to the other sinks: %v", third.written)
+	}
+}
+
+func TestSinkSetAccessHits(t *testing.T) {
+	initTestMetrics()
+	hits := []*accessCampaignHit{{}, {}, {}}
+	for i, tid := range []string{"tid-1", "tid-2", "tid-3"} {
+		hits[i].Tid = tid
+	}
+
+	first := &fakeSink{name: sinkPostgres, duplicates: map[string]bool{"tid-2": true}}
+	failed := &fakeSink{name: sinkClickHouse, err: errors.New("timeout")}
+	last := &fakeSink{name: sinkFile}
+	dups, err := sinkSet{first, failed, last}.accessHits(hits)
+	if err != nil {
+		t.Fatalf("accessHits: %s", err.Error())
+	}
+	if len(dups) != 1 || !dups["tid-2"] {
+		t.Errorf("duplicates = %v, want tid-2", dups)
+	}
+	if len(last.written) != 2 || last.written[0] != "tid-1" || last.written[1] != "tid-3" {
+		t.Errorf("last sink written %v, want the fresh hits", last.written)
+	}
+
+	first.err = errors.New("connection refused")
+	if _, err := (sinkSet{first, last}).accessHits(hits); err != first.err {
+		t.Errorf("first sink error = %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// HistoryConfig enables the append-only history of subscription changes,
+// one row for every changed field
+type HistoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// subscriptionHistory keeps the fields of the subscriptions before the update.
+// The rows are locked until the transaction of the event is committed
+type subscriptionHistory struct {
+	event  string
+	tid    string
+	fields []string
+	old    map[int64]subscriptionState
+}
+
+type subscriptionState struct {
+	msisdn string
+	values []string
+}
+
+// trackSubscriptions selects the fields of the subscriptions matching
+// the condition, it returns nil when the history is disabled
+func trackSubscriptions(db dbExecutor, event, tid string, fields []string, where string, args ...interface{}) (*subscriptionHistory, error) {
+	if !svc.sConfig.History.Enabled {
+		return nil, nil
+	}
+	h := &subscriptionHistory{
+		event:  event,
+		tid:    tid,
+		fields: fields,
+	}
+	var err error
+	if h.old, err = h.states(db, where+" FOR UPDATE", args...); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *subscriptionHistory) states(db dbExecutor, where string, args ...interface{}) (map[int64]subscriptionState, error) {
+	columns := make([]string, len(h.fields))
+	for i, f := range h.fields {
+		columns[i] = fmt.Sprintf("COALESCE(%s::text, '')", f)
+	}
+	query := fmt.Sprintf("SELECT id, msisdn, %s FROM %ssubscriptions WHERE %s",
+		strings.Join(columns, ", "),
+		svc.dbConf.TablePrefix,
+		where,
+	)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, newDBError("db.Query", err, query)
+	}
+	defer rows.Close()
+
+	states := make(map[int64]subscriptionState)
+	for rows.Next() {
+		var id int64
+		s := subscriptionState{values: make([]string, len(h.fields))}
+		dest := []interface{}{&id, &s.msisdn}
+		for i := range s.values {
+			dest = append(dest, &s.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, newDBError("rows.Scan", err, "")
+		}
+		states[id] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newDBError("rows.Err", err, "")
+	}
+	return states, nil
+}
+
+// write appends a history row for every changed field. The tracked rows
+// are read by id again: the update may move them out of the condition
+func (h *subscriptionHistory) write(db dbExecutor) error {
+	if h == nil || len(h.old) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(h.old))
+	for id := range h.old {
+		ids = append(ids, id)
+	}
+	current, err := h.states(db, "id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %ssubscriptions_history ("+
+		"id_subscription, "+
+		"msisdn, "+
+		"tid, "+
+		"event, "+
+		"field, "+
+		"old_value, "+
+		"new_value "+
+		") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		svc.dbConf.TablePrefix,
+	)
+	for id, old := range h.old {
+		s, ok := current[id]
+		if !ok {
+			continue
+		}
+		for i, f := range h.fields {
+			if old.values[i] == s.values[i] {
+				continue
+			}
+			if _, err := db.Exec(query, id, s.msisdn, h.tid, h.event, f, old.values[i], s.values[i]); err != nil {
+				return newDBError("db.Exec", err, query)
+			}
+		}
+	}
+	return nil
+}
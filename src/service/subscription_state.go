@@ -0,0 +1,126 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	rec "github.com/linkit360/go-utils/rec"
+)
+
+// subscription results
+const (
+	resultPaid        = "paid"
+	resultFailed      = "failed"
+	resultCanceled    = "canceled"
+	resultPurged      = "purged"
+	resultRejected    = "rejected"
+	resultBlacklisted = "blacklisted"
+	resultPostPaid    = "postpaid"
+)
+
+// TransitionsConfig configures the check of subscription result changes.
+// With audit the rejected changes are written to subscriptions_rejected_transitions
+type TransitionsConfig struct {
+	Audit bool `yaml:"audit"`
+}
+
+// subscriptionTransitions lists the results a subscription may move to.
+// A late paid must not bring back a canceled or blacklisted subscription.
+// Results not listed, e.g. empty for a new subscription, may move to any result
+// and any result may move to them
+var subscriptionTransitions = map[string][]string{
+	resultPaid: {resultPaid, resultFailed, resultCanceled, resultPurged,
+		resultRejected, resultBlacklisted, resultPostPaid},
+	resultFailed: {resultPaid, resultFailed, resultCanceled, resultPurged,
+		resultRejected, resultBlacklisted, resultPostPaid},
+	resultRejected:    {resultRejected, resultCanceled, resultPurged, resultBlacklisted, resultPostPaid},
+	resultCanceled:    {resultPurged, resultBlacklisted, resultPostPaid},
+	resultPurged:      {resultBlacklisted, resultPostPaid},
+	resultPostPaid:    {resultBlacklisted},
+	resultBlacklisted: {},
+}
+
+func transitionAllowed(from, to string) bool {
+	allowed, ok := subscriptionTransitions[from]
+	if !ok {
+		return true
+	}
+	if _, ok := subscriptionTransitions[to]; !ok {
+		return true
+	}
+	for _, result := range allowed {
+		if result == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionCond is the condition of the update moving the subscription
+// to the result, its two arguments are bound to $n and $n+1.
+// A result not listed matches every subscription, as any result may move to it
+func transitionCond(n int, to string) (string, []interface{}) {
+	var from, known []string
+	for result := range subscriptionTransitions {
+		known = append(known, result)
+	}
+	sort.Strings(known)
+	for _, result := range known {
+		if transitionAllowed(result, to) {
+			from = append(from, result)
+		}
+	}
+	cond := fmt.Sprintf("(COALESCE(result, '') = ANY($%d) OR NOT COALESCE(result, '') = ANY($%d))", n, n+1)
+	return cond, []interface{}{pq.Array(from), pq.Array(known)}
+}
+
+// checkTransition is called when the guarded update has changed nothing.
+// The query selects the id and the result of the subscription, if it exists
+// the transition has been rejected
+func checkTransition(db dbExecutor, event string, r rec.Record, to string, query string, args ...interface{}) error {
+	var id int64
+	var from string
+	if err := db.QueryRow(query, args...).Scan(&id, &from); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return newDBError("db.QueryRow", err, query)
+	}
+	return rejectTransition(db, event, r, id, from, to)
+}
+
+// rejectTransition logs and counts the rejected result change,
+// with audit it is written in the transaction of the event
+func rejectTransition(db dbExecutor, event string, r rec.Record, id int64, from, to string) error {
+	svc.m.MTManager.RejectedTransitions.Inc()
+	log.WithFields(log.Fields{
+		"tid":    r.Tid,
+		"msisdn": r.Msisdn,
+		"id":     id,
+		"event":  event,
+		"from":   from,
+		"to":     to,
+	}).Warn("subscription transition rejected")
+
+	if !svc.sConfig.Transitions.Audit {
+		return nil
+	}
+	query := fmt.Sprintf("INSERT INTO %ssubscriptions_rejected_transitions ("+
+		"id_subscription, "+
+		"tid, "+
+		"msisdn, "+
+		"event, "+
+		"result_from, "+
+		"result_to "+
+		") VALUES ($1, $2, $3, $4, $5, $6)",
+		svc.dbConf.TablePrefix,
+	)
+	if _, err := db.Exec(query, id, r.Tid, r.Msisdn, event, from, to); err != nil {
+		return newDBError("db.Exec", err, query)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestTransitionAllowed(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"", resultPaid, true},
+		{"", resultBlacklisted, true},
+		{resultPaid, resultFailed, true},
+		{resultFailed, resultPaid, true},
+		{resultRejected, resultPaid, false},
+		{resultCanceled, resultPaid, false},
+		{resultCanceled, resultPurged, true},
+		{resultPurged, resultCanceled, false},
+		{resultPostPaid, resultPaid, false},
+		{resultPostPaid, resultBlacklisted, true},
+		{resultBlacklisted, resultPaid, false},
+		{resultBlacklisted, resultBlacklisted, false},
+		// the results not listed move and are moved to freely
+		{"pending", resultPaid, true},
+		{resultBlacklisted, "pending", true},
+		{resultCanceled, "", true},
+	}
+	for _, tt := range tests {
+		if got := transitionAllowed(tt.from, tt.to); got != tt.want {
+			t.Errorf("transitionAllowed(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTransitionCond(t *testing.T) {
+	known := []string{resultBlacklisted, resultCanceled, resultFailed,
+		resultPaid, resultPostPaid, resultPurged, resultRejected}
+	tests := []struct {
+		to   string
+		from []string
+	}{
+		{resultPaid, []string{resultFailed, resultPaid}},
+		{resultPurged, []string{resultCanceled, resultFailed, resultPaid, resultRejected}},
+		{resultBlacklisted, []string{resultCanceled, resultFailed, resultPaid,
+			resultPostPaid, resultPurged, resultRejected}},
+		// the results not listed match every subscription
+		{"pending", known},
+		{"", known},
+	}
+	for _, tt := range tests {
+		cond, args := transitionCond(5, tt.to)
+		if want := "(COALESCE(result, '') = ANY($5) OR NOT COALESCE(result, '') = ANY($6))"; cond != want {
+			t.Errorf("transitionCond(%q) = %s", tt.to, cond)
+		}
+		if len(args) != 2 {
+			t.Fatalf("transitionCond(%q) arguments = %d, want 2", tt.to, len(args))
+		}
+		if got := fmt.Sprint(args[0]); got != fmt.Sprint(pq.Array(tt.from)) {
+			t.Errorf("transitionCond(%q) from = %s, want %v", tt.to, got, tt.from)
+		}
+		if got := fmt.Sprint(args[1]); got != fmt.Sprint(pq.Array(known)) {
+			t.Errorf("transitionCond(%q) known = %s, want %v", tt.to, got, known)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// sweeper runs fn periodically until stopped, a zero interval disables it
+type sweeper struct {
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newSweeper(interval time.Duration, fn func()) *sweeper {
+	s := &sweeper{
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(s.done)
+		return s
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	return s
+}
+
+// stop waits for the running sweep to finish
+func (s *sweeper) stop() {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+	<-s.done
+}
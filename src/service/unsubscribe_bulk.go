@@ -0,0 +1,211 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	rec "github.com/linkit360/go-utils/rec"
+)
+
+// BulkUnsubscribeConfig configures UnsubscribeCampaign and UnsubscribeService
+type BulkUnsubscribeConfig struct {
+	// ChunkSize is how many subscriptions are canceled in one transaction
+	ChunkSize int `yaml:"chunk_size" default:"500"`
+}
+
+// unsubscribeBulk cancels the active subscriptions of the campaign or the service.
+// Every chunk is committed on its own with its outflow in the outbox, so the
+// redelivered task continues with the subscriptions left active. Without the
+// outbox the outflow of the chunk is published once it is committed, the task
+// stops on the first failed publish.
+// Outflow is reported per subscription
+func unsubscribeBulk(event string, r rec.Record) (err error) {
+	begin := time.Now()
+	column, value := "id_campaign", r.CampaignId
+	if event == "UnsubscribeService" {
+		column, value = "id_service", r.ServiceCode
+	}
+	r.SubscriptionStatus = resultCanceled
+	if r.OutFlowReason == "" {
+		r.OutFlowReason = "bulk unsubscribe"
+	}
+	chunkSize := svc.sConfig.BulkUnsubscribe.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 500
+	}
+
+	var total int
+	fields := log.Fields{
+		"tid":   r.Tid,
+		"event": event,
+		column:  value,
+	}
+	defer func() {
+		fields["total"] = total
+		fields["took"] = time.Since(begin)
+		if err != nil {
+			fields["error"] = err.Error()
+			log.WithFields(fields).Error("bulk unsubscribe")
+			return
+		}
+		log.WithFields(fields).Info("bulk unsubscribe done")
+	}()
+
+	// chunks are walked by id: the subscriptions the update skips
+	// are not selected again
+	var lastId int64
+	for {
+		var c bulkChunk
+		err = withTx(sql.LevelReadCommitted, func(db dbExecutor) (err error) {
+			if c, err = unsubscribeChunk(db, event, r, column, value, lastId, chunkSize); err != nil {
+				return
+			}
+			return svc.outbox.add(db, c.reports)
+		})
+		if err != nil {
+			return
+		}
+		if !svc.outbox.enabled() {
+			for _, report := range c.reports {
+				if err = publishReporter(report.queue, report.collect); err != nil {
+					err = fmt.Errorf("publishReporter: %s", err.Error())
+					return
+				}
+			}
+		}
+		lastId = c.lastId
+		total += len(c.reports)
+		svc.m.MTManager.BulkUnsubscribedRows.Observe(float64(len(c.reports)))
+		if len(c.reports) > 0 {
+			log.WithFields(fields).WithFields(log.Fields{
+				"chunk": len(c.reports),
+				"total": total,
+			}).Info("bulk unsubscribe progress")
+		}
+		if c.selected < chunkSize {
+			break
+		}
+	}
+	svc.m.MTManager.BulkUnsubscribeDuration.Observe(time.Since(begin).Seconds())
+	svc.m.Common.DBUpdateDuration.Observe(time.Since(begin).Seconds())
+	return
+}
+
+// bulkChunk is the result of one chunk: the outflow of the canceled
+// subscriptions, how many were selected and the last selected id
+type bulkChunk struct {
+	reports  []reporterEvent
+	selected int
+	lastId   int64
+}
+
+// unsubscribeChunk cancels up to limit subscriptions after the id,
+// the rows are locked until commit
+func unsubscribeChunk(db dbExecutor, event string, r rec.Record, column, value string, afterId int64, limit int) (c bulkChunk, err error) {
+	c.lastId = afterId
+	query := fmt.Sprintf("SELECT "+
+		"id, "+
+		"msisdn, "+
+		"id_campaign, "+
+		"operator_code, "+
+		"attempts_count "+
+		"FROM %ssubscriptions "+
+		"WHERE %s = $1 AND id > $2 AND "+
+		"result NOT IN ('canceled', 'purged', 'rejected', 'blacklisted', 'postpaid') "+
+		"ORDER BY id LIMIT $3 "+
+		"FOR UPDATE",
+		svc.dbConf.TablePrefix,
+		column,
+	)
+	rows, err := db.Query(query, value, afterId, limit)
+	if err != nil {
+		err = newDBError("db.Query", err, query)
+		return
+	}
+	defer rows.Close()
+
+	recs := make(map[int64]rec.Record)
+	var ids []int64
+	for rows.Next() {
+		t := rec.Record{}
+		if err = rows.Scan(
+			&t.SubscriptionId,
+			&t.Msisdn,
+			&t.CampaignId,
+			&t.OperatorCode,
+			&t.AttemptsCount,
+		); err != nil {
+			err = newDBError("rows.Scan", err, "")
+			return
+		}
+		recs[t.SubscriptionId] = t
+		ids = append(ids, t.SubscriptionId)
+	}
+	if err = rows.Err(); err != nil {
+		err = newDBError("rows.Err", err, "")
+		return
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return
+	}
+	c.selected = len(ids)
+	c.lastId = ids[len(ids)-1]
+
+	history, err := trackSubscriptions(db, event, r.Tid, []string{"result", "outflow_reason"},
+		"id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return
+	}
+
+	// only the canceled subscriptions are reported
+	cond, condArgs := transitionCond(5, r.SubscriptionStatus)
+	query = fmt.Sprintf("UPDATE %ssubscriptions SET "+
+		"result = $1, "+
+		"outflow_reason = $2, "+
+		"last_pay_attempt_at = $3 "+
+		"WHERE id = ANY($4) AND "+cond+" "+
+		"RETURNING id",
+		svc.dbConf.TablePrefix,
+	)
+	updated, err := db.Query(query, append([]interface{}{
+		r.SubscriptionStatus,
+		r.OutFlowReason,
+		r.SentAt,
+		pq.Array(ids),
+	}, condArgs...)...)
+	if err != nil {
+		err = newDBError("db.Query", err, query)
+		return
+	}
+	defer updated.Close()
+	var canceled []int64
+	for updated.Next() {
+		var id int64
+		if err = updated.Scan(&id); err != nil {
+			err = newDBError("rows.Scan", err, "")
+			return
+		}
+		canceled = append(canceled, id)
+	}
+	if err = updated.Err(); err != nil {
+		err = newDBError("rows.Err", err, "")
+		return
+	}
+	updated.Close()
+	if err = history.write(db); err != nil {
+		return
+	}
+
+	for _, id := range canceled {
+		t := recs[id]
+		t.Tid = r.Tid
+		t.Result = r.SubscriptionStatus
+		c.reports = append(c.reports, outflowReport(t))
+	}
+	return c, nil
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	rec "github.com/linkit360/go-utils/rec"
+)
+
+func TestUnsubscribeBulkSkipsSubscriptionsNotUpdated(t *testing.T) {
+	columns := []string{"id", "msisdn", "id_campaign", "operator_code", "attempts_count"}
+	var active [][]driver.Value
+	for id := int64(1); id <= 5; id++ {
+		active = append(active, []driver.Value{id, fmt.Sprintf("7900000000%d", id), "campaign-a", int64(41001), int64(0)})
+	}
+	// the update skips the subscriptions 2 and 3, they stay active
+	stuck := map[string]bool{"2": true, "3": true}
+
+	fake, db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT id, msisdn"):
+			afterId, limit := args[1].(int64), args[2].(int64)
+			var rows [][]driver.Value
+			for _, row := range active {
+				if row[0].(int64) > afterId && int64(len(rows)) < limit {
+					rows = append(rows, row)
+				}
+			}
+			return fakeResult{columns: columns, rows: rows}, nil
+		case strings.HasPrefix(query, "UPDATE subscriptions"):
+			var rows [][]driver.Value
+			for _, id := range strings.Split(strings.Trim(args[3].(string), "{}"), ",") {
+				if !stuck[id] {
+					var v int64
+					fmt.Sscan(id, &v)
+					rows = append(rows, []driver.Value{v})
+				}
+			}
+			return fakeResult{columns: []string{"id"}, rows: rows}, nil
+		case strings.HasPrefix(query, "INSERT INTO reporter_outbox"):
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	})
+	defer db.Close()
+	useTestDB(t, db)
+	svc.outbox = &outbox{conf: OutboxConfig{Enabled: true}}
+	svc.sConfig.BulkUnsubscribe.ChunkSize = 2
+
+	e := &Event{
+		Name: "UnsubscribeCampaign",
+		Tid:  "tid-bulk",
+		Data: &mtManagerEvent{Record: rec.Record{Tid: "tid-bulk", CampaignId: "campaign-a"}},
+	}
+	h := mtManagerHandler{}
+	if err := h.Validate(e, log.WithField("test", t.Name())); err != nil {
+		t.Fatalf("Validate: %s", err.Error())
+	}
+	if err := h.Persist(e); err != nil {
+		t.Fatalf("Persist: %s", err.Error())
+	}
+
+	if selects := fake.executed("SELECT id, msisdn"); len(selects) != 3 {
+		t.Errorf("chunks = %d, want 3", len(selects))
+	}
+	var msisdns []string
+	for _, q := range fake.executed("INSERT INTO reporter_outbox") {
+		var body struct {
+			EventData struct {
+				Msisdn string `json:"msisdn"`
+			} `json:"event_data"`
+		}
+		if err := json.Unmarshal([]byte(q.args[1].(string)), &body); err != nil {
+			t.Fatalf("outbox body: %s", err.Error())
+		}
+		msisdns = append(msisdns, body.EventData.Msisdn)
+	}
+	if got := strings.Join(msisdns, ","); got != "79000000001,79000000004,79000000005" {
+		t.Errorf("outflow of %s, want the updated subscriptions only", got)
+	}
+}
+
+func TestUnsubscribeBulkWithoutOutboxStopsOnPublishError(t *testing.T) {
+	columns := []string{"id", "msisdn", "id_campaign", "operator_code", "attempts_count"}
+	fake, db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT id, msisdn"):
+			afterId := args[1].(int64)
+			return fakeResult{columns: columns, rows: [][]driver.Value{
+				{afterId + 1, "79000000001", "campaign-a", int64(41001), int64(0)},
+				{afterId + 2, "79000000002", "campaign-a", int64(41001), int64(0)},
+			}}, nil
+		case strings.HasPrefix(query, "UPDATE subscriptions"):
+			return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	})
+	defer db.Close()
+	useTestDB(t, db)
+	// the broker is down: the outflow of the first chunk is not published
+	svc.publisher = &publisher{closed: true}
+	svc.sConfig.BulkUnsubscribe.ChunkSize = 2
+
+	e := &Event{
+		Name: "UnsubscribeService",
+		Tid:  "tid-bulk",
+		Data: &mtManagerEvent{Record: rec.Record{Tid: "tid-bulk", ServiceCode: "777"}},
+	}
+	h := mtManagerHandler{}
+	if err := h.Validate(e, log.WithField("test", t.Name())); err != nil {
+		t.Fatalf("Validate: %s", err.Error())
+	}
+	if err := h.Persist(e); err == nil {
+		t.Fatal("Persist: no error, want the publish error")
+	}
+	// the task stops after the first chunk and is redelivered
+	if selects := fake.executed("SELECT id, msisdn"); len(selects) != 1 {
+		t.Errorf("chunks = %d, want 1", len(selects))
+	}
+	if updates := fake.executed("UPDATE subscriptions"); len(updates) != 1 {
+		t.Errorf("updates = %d, want 1", len(updates))
+	}
+}
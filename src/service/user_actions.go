@@ -2,11 +2,8 @@ package service
 
 import (
 	"encoding/json"
-	"fmt"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 )
@@ -16,103 +13,55 @@ type EventNotifyUserActions struct {
 	EventData rbmq.UserActionsNotify `json:"event_data,omitempty"`
 }
 
-func processUserActions(deliveries <-chan amqp.Delivery) {
+type userActionsHandler struct{}
 
-	for msg := range deliveries {
-		logCtx := log.WithFields(log.Fields{
-			"q": svc.sConfig.Queue.UserActions.Name,
-		})
-		var query string
-		var e EventNotifyUserActions
-		var t rbmq.UserActionsNotify
-		var begin time.Time
-
-		if err := json.Unmarshal(msg.Body, &e); err != nil {
-			svc.m.UserActions.Dropped.Inc()
-
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("failed")
-			goto ack
-		}
-
-		t = e.EventData
-		if t.Tid == "" || t.Action == "" {
-			svc.m.UserActions.Dropped.Inc()
-			svc.m.UserActions.Empty.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": "Empty message",
-				"msg":   "dropped",
-				"body":  string(msg.Body),
-			}).Error("discarding")
-			goto ack
-		}
-		logCtx = logCtx.WithFields(log.Fields{
-			"tid": t.Tid,
-		})
-		if len(t.Msisdn) > 32 {
-			logCtx.WithFields(log.Fields{
-				"msisdn": t.Msisdn,
-				"error":  "strange msisdn",
-			}).Error("")
-			t.Msisdn = t.Msisdn[:31]
-		}
-		if t.CampaignId == "" {
-			t.CampaignId = "0"
-		}
-
-		begin = time.Now()
-		query = fmt.Sprintf("INSERT INTO %suser_actions ("+
-			"sent_at, "+
-			"id_campaign, "+
-			"msisdn, "+
-			"tid, "+
-			"action, "+
-			"error "+
-			") values ($1, $2, $3, $4, $5, $6)",
-			svc.dbConf.TablePrefix)
+func (userActionsHandler) Queue() string {
+	return svc.sConfig.Queue.UserActions.Name
+}
 
-		if _, err := svc.db.Exec(query,
-			t.SentAt,
-			t.CampaignId,
-			t.Msisdn,
-			t.Tid,
-			t.Action,
-			t.Error,
-		); err != nil {
-			svc.m.Common.DBErrors.Inc()
-			svc.m.UserActions.AddToDBErrors.Inc()
+func (userActionsHandler) Metrics() *queueMetrics {
+	return &svc.m.UserActions.queueMetrics
+}
 
-			logCtx.WithFields(log.Fields{
-				"query": query,
-				"msg":   "requeue",
-				"error": err.Error(),
-				"body":  string(msg.Body),
-			}).Error("failed")
-			time.Sleep(time.Second)
-			msg.Nack(false, true)
-			continue
-		}
+func (userActionsHandler) Decode(body []byte) (*Event, error) {
+	var e EventNotifyUserActions
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Name: e.EventName,
+		Tid:  e.EventData.Tid,
+		Data: &e.EventData,
+	}, nil
+}
 
-		svc.m.UserActions.AddToDbSuccess.Inc()
-		svc.m.UserActions.AddToDBDuration.Observe(time.Since(begin).Seconds())
-		svc.m.Common.DBInsertDuration.Observe(time.Since(begin).Seconds())
+func (userActionsHandler) Validate(e *Event, logCtx *log.Entry) error {
+	t := e.Data.(*rbmq.UserActionsNotify)
 
+	if t.Tid == "" || t.Action == "" {
+		return errEmptyMessage
+	}
+	if len(t.Msisdn) > 32 {
 		logCtx.WithFields(log.Fields{
-			"took": time.Since(begin).String(),
-		}).Info("success")
-	ack:
-		if err := msg.Ack(false); err != nil {
-			svc.m.Common.Errors.Inc()
-
-			logCtx.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
+			"msisdn": t.Msisdn,
+			"error":  "strange msisdn",
+		}).Error("")
+		t.Msisdn = t.Msisdn[:31]
+	}
+	if t.CampaignId == "" {
+		t.CampaignId = "0"
 	}
+	return nil
+}
+
+func (userActionsHandler) Persist(e *Event) error {
+	t := e.Data.(*rbmq.UserActionsNotify)
+	_, err := svc.sinks.UserActions.write(func(s Sink) (bool, error) {
+		return false, s.UserAction(t)
+	})
+	return err
+}
+
+func (userActionsHandler) Publish(e *Event) error {
+	return nil
 }
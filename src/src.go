@@ -2,7 +2,14 @@ package src
 
 // purpose is to save in database
 import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -13,9 +20,25 @@ import (
 	m "github.com/linkit360/go-utils/metrics"
 )
 
+var (
+	backfillLongitude = flag.Bool("backfill-longitude", false, "recompute the geoip coordinates of campaigns_access rows with longitude = latitude and exit")
+	backfillBatchSize = flag.Int("backfill-batch-size", 1000, "rows updated in one transaction by the backfill")
+	backfillFromId    = flag.Int64("backfill-from-id", 0, "campaigns_access id the backfill starts after")
+)
+
 func RunServer() {
 	appConfig := config.LoadConfig()
 
+	if *backfillLongitude {
+		if err := service.BackfillLongitude(appConfig.Service, appConfig.DbConf, service.BackfillConfig{
+			BatchSize: *backfillBatchSize,
+			FromId:    *backfillFromId,
+		}); err != nil {
+			log.WithField("error", err.Error()).Fatal("backfill longitude")
+		}
+		return
+	}
+
 	service.InitService(
 		appConfig.AppName,
 		appConfig.Service,
@@ -32,7 +55,27 @@ func RunServer() {
 	r := gin.New()
 
 	m.AddHandler(r)
+	service.AddAdminHandler(r)
+	service.AddHealthHandler(r)
+
+	srv := &http.Server{
+		Addr:    appConfig.Server.Host + ":" + appConfig.Server.Port,
+		Handler: r,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithField("error", err.Error()).Fatal("server")
+		}
+	}()
+	log.WithField("dsn", srv.Addr).Info("init")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.WithField("signal", (<-sig).String()).Info("stopping")
+
+	service.Shutdown(time.Duration(appConfig.Service.ShutdownTimeoutSeconds) * time.Second)
 
-	r.Run(appConfig.Server.Host + ":" + appConfig.Server.Port)
-	log.WithField("dsn", appConfig.Server.Host+":"+appConfig.Server.Port).Info("init")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
 }